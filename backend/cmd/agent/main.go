@@ -3,9 +3,27 @@ package main
 import (
 	"calc-website/config"
 	"calc-website/internal/agent"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
 )
 
 func main() {
-	cfg := config.LoadConfig()
+	cfg, options, err := config.LoadConfig()
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(2)
+	}
+	if options.PrintConfig {
+		if err := cfg.WriteYAML(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	agent.Run(cfg)
 }
@@ -3,13 +3,32 @@ package main
 import (
 	"calc-website/config"
 	"calc-website/internal/orchestrator"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
 )
 
 func main() {
-	cfg := config.LoadConfig()
-	err := orchestrator.Run(cfg)
+	cfg, options, err := config.LoadConfig()
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(2)
+	}
+	if options.PrintConfig {
+		if err := cfg.WriteYAML(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	err = orchestrator.Run(cfg)
 	if err != nil {
-		log.Printf("run orchestrator error: %v", err.Error())
+		slog.Error("run orchestrator error", "error", err)
+		os.Exit(1)
 	}
 }
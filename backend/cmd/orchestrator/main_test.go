@@ -5,22 +5,46 @@ import (
 	"calc-website/config"
 	"calc-website/internal/models"
 	"calc-website/internal/orchestrator"
+	"calc-website/pkg/cache"
+	"calc-website/pkg/calc"
+	"calc-website/pkg/logging"
+	"calc-website/pkg/tracing"
 	"calc-website/pkg/utils"
 	"encoding/json"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
-func startTestServer() *httptest.Server {
-	service := orchestrator.NewAPIService(&config.Config{
+func newTestConfig() *config.Config {
+	return &config.Config{
 		TimeAdditionMs:        100,
 		TimeSubtractionMs:     100,
 		TimeMultiplicationsMs: 100,
 		TimeDivisionsMs:       100,
 		ComputingPower:        10,
-	})
+		WebhookSecret:         "test-secret",
+		WebhookMaxAttempts:    3,
+		WebhookBackoffMs:      10,
+		ResultCacheSize:       100,
+	}
+}
+
+func startTestServer() *httptest.Server {
+	return startTestServerWithConfig(newTestConfig())
+}
+
+func startTestServerWithConfig(cfg *config.Config) *httptest.Server {
+	service := orchestrator.NewAPIService(cfg)
 	handler := orchestrator.NewAPIHandler(service)
 
 	server := httptest.NewServer(handler.Router())
@@ -224,3 +248,996 @@ func TestPostTaskResult(t *testing.T) {
 
 	checkStatusCode(t, resp, http.StatusOK)
 }
+
+// drainTasks работает как агент: выполняет задачи, пока очередь не опустеет
+func drainTasks(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	client := &http.Client{}
+	for {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/internal/task", nil)
+		req.Header.Set(models.AgentIDHeader, "test-agent")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			utils.CloseResponseBody(resp.Body)
+			return
+		}
+		var task models.TaskResponse
+		err = json.NewDecoder(resp.Body).Decode(&task)
+		utils.CloseResponseBody(resp.Body)
+		if err != nil {
+			t.Fatal("Ошибка декодирования JSON:", err)
+		}
+
+		result, _ := calc.Compute(task.Arg1, task.Arg2, task.Operation)
+		resultBody, _ := json.Marshal(models.TaskResult{TaskID: task.ID, Result: result})
+		req, _ = http.NewRequest(http.MethodPost, server.URL+"/internal/task", bytes.NewBuffer(resultBody))
+		req.Header.Set(tracing.Header, resp.Header.Get(tracing.Header))
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		utils.CloseResponseBody(resp.Body)
+	}
+}
+
+func TestCompletionWebhook(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	var attempts atomic.Int32
+	received := make(chan []byte, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(orchestrator.SignatureHeader) != orchestrator.SignPayload("test-secret", body) {
+			t.Error("Неверная подпись вебхука")
+		}
+		// первая попытка завершается ошибкой, чтобы проверить повторную отправку
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received <- body
+	}))
+	defer callback.Close()
+
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "2 + 3", CallbackURL: callback.URL})
+	resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusCreated)
+
+	var responseMap map[string]map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&responseMap)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	id := responseMap["expression"]["id"]
+
+	drainTasks(t, server)
+
+	select {
+	case body := <-received:
+		var expression models.Expression
+		err = json.Unmarshal(body, &expression)
+		if err != nil {
+			t.Fatal("Ошибка декодирования JSON:", err)
+		}
+		if expression.Status != models.StatusConfirmed || expression.Result != 5 {
+			t.Errorf("Получено выражение %+v, ожидался результат 5", expression)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Вебхук не был доставлен")
+	}
+
+	// журнал доставки пополняется после ответа получателя
+	var deliveries map[string][]models.WebhookDelivery
+	for i := 0; i < 50 && len(deliveries["deliveries"]) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		resp, err = http.Get(server.URL + "/api/v1/expressions/" + id + "/deliveries")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStatusCode(t, resp, http.StatusOK)
+		err = json.NewDecoder(resp.Body).Decode(&deliveries)
+		utils.CloseResponseBody(resp.Body)
+		if err != nil {
+			t.Fatal("Ошибка декодирования JSON:", err)
+		}
+	}
+	if len(deliveries["deliveries"]) != 2 || !deliveries["deliveries"][1].Success {
+		t.Errorf("Ожидалось две попытки доставки, получено %+v", deliveries["deliveries"])
+	}
+}
+
+func TestSharedSubexpressions(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "(7 + 8) * (7 + 8)"})
+	resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusCreated)
+
+	resp, err = http.Get(server.URL + "/internal/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatusCode(t, resp, http.StatusOK)
+	utils.CloseResponseBody(resp.Body)
+
+	// одинаковое подвыражение 7 + 8 должно быть поставлено в очередь только один раз
+	resp, err = http.Get(server.URL + "/internal/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatusCode(t, resp, http.StatusNotFound)
+	utils.CloseResponseBody(resp.Body)
+}
+
+func TestResultCache(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	for _, expression := range []string{"4 * 5 + 1", "1 + 5 * 4"} {
+		requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: expression})
+		resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		utils.CloseResponseBody(resp.Body)
+		checkStatusCode(t, resp, http.StatusCreated)
+		drainTasks(t, server)
+	}
+
+	resp, err := http.Get(server.URL + "/api/v1/expressions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	var expressions map[string][]models.Expression
+	err = json.NewDecoder(resp.Body).Decode(&expressions)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	for _, expression := range expressions["expressions"] {
+		if expression.Status != models.StatusConfirmed || expression.Result != 21 {
+			t.Errorf("Получено выражение %+v, ожидался результат 21", expression)
+		}
+	}
+
+	// второе выражение полностью вычисляется из кэша
+	resp, err = http.Get(server.URL + "/api/v1/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	var stats map[string]cache.Stats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	if stats["cache"].Hits != 2 || stats["cache"].Misses != 2 {
+		t.Errorf("Статистика кэша %+v, ожидалось 2 попадания и 2 промаха", stats["cache"])
+	}
+}
+
+func TestOptimizedExpression(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "(1 + 2 + 3 + 4) * 1 + 0", Optimize: true})
+	resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusCreated)
+
+	var responseMap map[string]map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&responseMap)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	drainTasks(t, server)
+
+	resp, err = http.Get(server.URL + "/api/v1/expressions/" + responseMap["expression"]["id"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	var expression map[string]models.Expression
+	err = json.NewDecoder(resp.Body).Decode(&expression)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	if expression["expression"].Optimized != "((1 + 2) + (3 + 4))" || expression["expression"].Result != 10 {
+		t.Errorf("Получено выражение %+v, ожидалась упрощённая форма ((1 + 2) + (3 + 4)) и результат 10", expression["expression"])
+	}
+}
+
+func TestCriticalPathScheduling(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	// 5 * 6 попадает в очередь первым, но цепочка 1 + 2 + 3 + 4 длиннее
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "5 * 6 + (1 + 2 + 3 + 4)"})
+	resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusCreated)
+
+	resp, err = http.Get(server.URL + "/internal/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusOK)
+
+	var task models.TaskResponse
+	err = json.NewDecoder(resp.Body).Decode(&task)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	if task.Operation != "+" || task.Arg1 != 1 || task.Arg2 != 2 {
+		t.Errorf("Получена задача %+v, ожидалась 1 + 2 с критического пути", task)
+	}
+}
+
+func TestExpressionPriority(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	var ids []string
+	for _, request := range []models.ExpressionRequest{
+		{Expression: "1 + 2", Priority: models.PriorityLow},
+		{Expression: "3 + 4", Priority: models.PriorityHigh},
+	} {
+		requestBody, _ := json.Marshal(request)
+		resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStatusCode(t, resp, http.StatusCreated)
+		var responseMap map[string]map[string]string
+		err = json.NewDecoder(resp.Body).Decode(&responseMap)
+		utils.CloseResponseBody(resp.Body)
+		if err != nil {
+			t.Fatal("Ошибка декодирования JSON:", err)
+		}
+		ids = append(ids, responseMap["expression"]["id"])
+	}
+
+	// повышаем приоритет первого выражения после отправки
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/api/v1/expressions/"+ids[0]+"/priority",
+		bytes.NewBufferString(`{"priority": "high"}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusOK)
+
+	req, _ = http.NewRequest(http.MethodPut, server.URL+"/api/v1/expressions/"+ids[1]+"/priority",
+		bytes.NewBufferString(`{"priority": "urgent"}`))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusUnprocessableEntity)
+
+	req, _ = http.NewRequest(http.MethodPut, server.URL+"/api/v1/expressions/"+ids[1]+"/priority",
+		bytes.NewBufferString(`{"priority": "low"}`))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusOK)
+
+	resp, err = http.Get(server.URL + "/internal/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	var task models.TaskResponse
+	err = json.NewDecoder(resp.Body).Decode(&task)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	if task.Arg1 != 1 || task.Arg2 != 2 {
+		t.Errorf("Получена задача %+v, ожидалась 1 + 2 из выражения с высоким приоритетом", task)
+	}
+}
+
+func TestBacklogAdmissionControl(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.MaxBacklog = 2
+	server := startTestServerWithConfig(cfg)
+	defer server.Close()
+
+	expected := []int{http.StatusCreated, http.StatusServiceUnavailable, http.StatusCreated}
+	for i, expression := range []string{"1 + 2 * 3", "4 + 5", "6 - 7"} {
+		requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: expression})
+		resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		utils.CloseResponseBody(resp.Body)
+		checkStatusCode(t, resp, expected[i])
+
+		// после обработки очереди место для новых выражений освобождается
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			drainTasks(t, server)
+		}
+	}
+}
+
+func TestDeleteExpression(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "2 * 9"})
+	resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responseMap map[string]map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&responseMap)
+	utils.CloseResponseBody(resp.Body)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	url := server.URL + "/api/v1/expressions/" + responseMap["expression"]["id"]
+
+	// незавершённое выражение удалить нельзя
+	expected := []int{http.StatusConflict, http.StatusNoContent, http.StatusNotFound}
+	for i, status := range expected {
+		if i == 1 {
+			drainTasks(t, server)
+		}
+		req, _ := http.NewRequest(http.MethodDelete, url, nil)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		utils.CloseResponseBody(resp.Body)
+		checkStatusCode(t, resp, status)
+	}
+}
+
+func TestCallbackRequiresSecret(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.WebhookSecret = ""
+	server := startTestServerWithConfig(cfg)
+	defer server.Close()
+
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "2 + 3", CallbackURL: "http://example.com/hook"})
+	resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusUnprocessableEntity)
+
+	var errorResponse models.ErrorResponse
+	err = json.NewDecoder(resp.Body).Decode(&errorResponse)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	if errorResponse.Code != models.CodeCallbacksDisabled {
+		t.Errorf("Получен код %s, ожидался %s", errorResponse.Code, models.CodeCallbacksDisabled)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{http.MethodPost, "/api/v1/calculate", `{"expression": "3 ++ 4"}`, http.StatusUnprocessableEntity, models.CodeExpressionInvalid},
+		{http.MethodPost, "/api/v1/calculate", `{"expression": "3 / 0"}`, http.StatusUnprocessableEntity, models.CodeDivisionByZero},
+		{http.MethodPost, "/api/v1/calculate", `{"expression": `, http.StatusUnprocessableEntity, models.CodeRequestInvalid},
+		{http.MethodGet, "/api/v1/calculate", "", http.StatusMethodNotAllowed, models.CodeMethodNotAllowed},
+		{http.MethodGet, "/api/v1/expressions/" + string(models.NewID()), "", http.StatusNotFound, models.CodeNotFound},
+		{http.MethodGet, "/api/v1/expressions/abc", "", http.StatusUnprocessableEntity, models.CodeIDInvalid},
+		{http.MethodPost, "/internal/task", `{"id": "` + string(models.NewID()) + `", "result": 1}`, http.StatusNotFound, models.CodeNotFound},
+		{http.MethodGet, "/internal/task", "", http.StatusNotFound, models.CodeNotFound},
+	}
+
+	for _, tc := range tests {
+		req, _ := http.NewRequest(tc.method, server.URL+tc.path, bytes.NewBufferString(tc.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var errorResponse models.ErrorResponse
+		err = json.NewDecoder(resp.Body).Decode(&errorResponse)
+		utils.CloseResponseBody(resp.Body)
+		if err != nil {
+			t.Fatalf("%s %s: ошибка декодирования JSON: %v", tc.method, tc.path, err)
+		}
+		if resp.StatusCode != tc.status || errorResponse.Code != tc.code {
+			t.Errorf("%s %s: получен %d %s, ожидался %d %s",
+				tc.method, tc.path, resp.StatusCode, errorResponse.Code, tc.status, tc.code)
+		}
+	}
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	tests := []struct {
+		acceptLanguage string
+		message        string
+	}{
+		{"ru-RU,ru;q=0.9,en;q=0.8", "деление на ноль"},
+		{"de, en;q=0.5, ru;q=0.3", "division by zero"},
+		{"en;q=0.2, ru", "деление на ноль"},
+		{"", "division by zero"},
+	}
+
+	for _, tc := range tests {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/v1/calculate",
+			bytes.NewBufferString(`{"expression": "1 / 0"}`))
+		req.Header.Set("Accept-Language", tc.acceptLanguage)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var errorResponse models.ErrorResponse
+		err = json.NewDecoder(resp.Body).Decode(&errorResponse)
+		utils.CloseResponseBody(resp.Body)
+		if err != nil {
+			t.Fatal("Ошибка декодирования JSON:", err)
+		}
+		if errorResponse.Code != models.CodeDivisionByZero || errorResponse.Message != tc.message {
+			t.Errorf("Accept-Language %q: получено %s %q, ожидалось %s %q", tc.acceptLanguage,
+				errorResponse.Code, errorResponse.Message, models.CodeDivisionByZero, tc.message)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	for agents, expectedMs := range map[int]int{1: 400, 2: 300} {
+		requestBody, _ := json.Marshal(models.ExplainRequest{Expression: "(1 + 2) * (1 + 2) + 3 * 4", Agents: agents})
+		resp, err := http.Post(server.URL+"/api/v1/explain", "application/json", bytes.NewBuffer(requestBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStatusCode(t, resp, http.StatusOK)
+		var response map[string]models.ExplainResponse
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		utils.CloseResponseBody(resp.Body)
+		if err != nil {
+			t.Fatal("Ошибка декодирования JSON:", err)
+		}
+
+		plan := response["plan"]
+		if plan.Infix != "(((1 + 2) * (1 + 2)) + (3 * 4))" || plan.AST == nil || plan.AST.Value != "+" {
+			t.Errorf("Получено дерево %q, ожидалось (((1 + 2) * (1 + 2)) + (3 * 4))", plan.Infix)
+		}
+		// общее подвыражение 1 + 2 вычисляется один раз
+		if len(plan.Tasks) != 4 || plan.Depth != 3 || plan.Width != 2 {
+			t.Errorf("Получен план из %d задач глубиной %d и шириной %d, ожидалось 4, 3 и 2",
+				len(plan.Tasks), plan.Depth, plan.Width)
+		}
+		if plan.EstimatedMs != expectedMs {
+			t.Errorf("Оценка для %d агентов %d мс, ожидалось %d мс", agents, plan.EstimatedMs, expectedMs)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/internal/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusNotFound)
+}
+
+func TestExpressionTrace(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "2 + 3 * 4"})
+	resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responseMap map[string]map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&responseMap)
+	utils.CloseResponseBody(resp.Body)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	url := server.URL + "/api/v1/expressions/" + responseMap["expression"]["id"] + "/trace"
+
+	// трассировка доступна только для завершённого выражения
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusConflict)
+
+	drainTasks(t, server)
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatusCode(t, resp, http.StatusOK)
+	var response map[string][]models.TaskTrace
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	utils.CloseResponseBody(resp.Body)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+
+	trace := response["trace"]
+	if len(trace) != 2 {
+		t.Fatalf("Получено %d задач, ожидалось 2", len(trace))
+	}
+	if trace[0].Operation != "*" || trace[0].Result != 12 || trace[1].Operation != "+" || trace[1].Result != 14 {
+		t.Errorf("Неверный порядок или результаты задач: %+v", trace)
+	}
+	for _, task := range trace {
+		if task.AgentID != "test-agent" || task.LeasedAt == nil {
+			t.Errorf("Задача %s не привязана к агенту", task.ID)
+			continue
+		}
+		if task.LeasedAt.Before(task.EnqueuedAt) || task.CompletedAt.Before(*task.LeasedAt) || task.WaitMs < 0 {
+			t.Errorf("Неверные временные метки задачи %s: %+v", task.ID, task)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "2 + 3 * 4"})
+	resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	drainTasks(t, server)
+	resp, err = http.Get(server.URL + "/api/v1/expressions/" + string(models.NewID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	req, _ := http.NewRequest("BREW", server.URL+"/api/v1/expressions", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+
+	resp, err = http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatusCode(t, resp, http.StatusOK)
+	body, _ := io.ReadAll(resp.Body)
+	utils.CloseResponseBody(resp.Body)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Неверный Content-Type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	for _, sample := range []string{
+		`calc_queue_depth 0`,
+		`calc_backlog_tasks 0`,
+		`calc_tasks_dispatched_total{operation="*"} 1`,
+		`calc_tasks_confirmed_total{operation="+"} 1`,
+		`calc_expression_duration_seconds_count{priority="normal"} 1`,
+		`calc_http_request_duration_seconds_count{route="/api/v1/calculate",method="POST",code="201"} 1`,
+		`calc_http_request_duration_seconds_count{route="/api/v1/expressions/{id}",method="GET",code="404"} 1`,
+		`calc_http_request_duration_seconds_count{route="/internal/task",method="GET",code="200"} 2`,
+	} {
+		if !strings.Contains(string(body), sample+"\n") {
+			t.Errorf("Метрики не содержат %q", sample)
+		}
+	}
+	if strings.Contains(string(body), `method="BREW"`) || !strings.Contains(string(body), `method="other"`) {
+		t.Error("Произвольный метод запроса попал в метку метрики")
+	}
+}
+
+func TestDistributedTrace(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.TraceFile = filepath.Join(t.TempDir(), "trace.jsonl")
+	server := startTestServerWithConfig(cfg)
+	defer server.Close()
+
+	clientContext := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "2 + 3 * 4"})
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/v1/calculate", bytes.NewBuffer(requestBody))
+	req.Header.Set(tracing.Header, clientContext)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responseMap map[string]map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&responseMap)
+	utils.CloseResponseBody(resp.Body)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	drainTasks(t, server)
+
+	resp, err = http.Get(server.URL + "/api/v1/expressions/" + responseMap["expression"]["id"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expressionMap map[string]models.Expression
+	err = json.NewDecoder(resp.Body).Decode(&expressionMap)
+	utils.CloseResponseBody(resp.Body)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	expression := expressionMap["expression"]
+	if expression.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Выражение относится к трассе %q, ожидалась трасса клиента", expression.TraceID)
+	}
+
+	data, err := os.ReadFile(cfg.TraceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spans := map[string]tracing.Span{}
+	children := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var span tracing.Span
+		if err := json.Unmarshal([]byte(line), &span); err != nil {
+			t.Fatal(err)
+		}
+		if span.TraceID != expression.TraceID {
+			t.Errorf("Спан %s относится к другой трассе", span.Name)
+		}
+		spans[span.SpanID] = span
+		children[span.ParentID] = append(children[span.ParentID], span.Name)
+	}
+
+	// выражение -> задачи -> подтверждения результатов агентов
+	if len(spans) != 5 || len(children["00f067aa0ba902b7"]) != 1 {
+		t.Fatalf("Получено %d спанов: %v", len(spans), children)
+	}
+	for _, span := range spans {
+		switch span.Name {
+		case "expression":
+			if len(children[span.SpanID]) != 2 {
+				t.Errorf("У спана выражения %d дочерних задач, ожидалось 2", len(children[span.SpanID]))
+			}
+		case "task +", "task *":
+			if len(children[span.SpanID]) != 1 || children[span.SpanID][0] != "confirm task" {
+				t.Errorf("Спан %s не связан с подтверждением результата: %v", span.Name, children[span.SpanID])
+			}
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/expressions", nil)
+	req.Header.Set(logging.RequestIDHeader, "client-request-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	if resp.Header.Get(logging.RequestIDHeader) != "client-request-1" {
+		t.Errorf("Получен идентификатор запроса %q, ожидался client-request-1", resp.Header.Get(logging.RequestIDHeader))
+	}
+
+	resp, err = http.Get(server.URL + "/api/v1/expressions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	if _, err := models.ParseID(resp.Header.Get(logging.RequestIDHeader)); err != nil {
+		t.Errorf("Сгенерирован неверный идентификатор запроса %q", resp.Header.Get(logging.RequestIDHeader))
+	}
+}
+
+// lockedBuffer collects log output written by the server goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServiceLogsCarryRequestID(t *testing.T) {
+	var logs lockedBuffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(logging.NewLogger(&logs))
+	defer slog.SetDefault(defaultLogger)
+
+	server := startTestServer()
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/v1/calculate",
+		strings.NewReader(`{"expression": "2 + 3"}`))
+	req.Header.Set(logging.RequestIDHeader, "client-request-2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusCreated)
+
+	for _, line := range strings.Split(logs.String(), "\n") {
+		var record map[string]any
+		if json.Unmarshal([]byte(line), &record) == nil && record["msg"] == "expression created" {
+			if record["request_id"] != "client-request-2" {
+				t.Errorf("Запись %q без идентификатора запроса client-request-2", line)
+			}
+			return
+		}
+	}
+	t.Errorf("В логе нет записи о создании выражения:\n%s", logs.String())
+}
+
+func TestHealthAndReturnTask(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		utils.CloseResponseBody(resp.Body)
+		checkStatusCode(t, resp, http.StatusOK)
+	}
+
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "2 + 3"})
+	resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+
+	// возвращённая агентом задача снова выдаётся
+	var ids []models.ID
+	for range 2 {
+		resp, err = http.Get(server.URL + "/internal/task")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var task models.TaskResponse
+		err = json.NewDecoder(resp.Body).Decode(&task)
+		utils.CloseResponseBody(resp.Body)
+		if err != nil {
+			t.Fatal("Ошибка декодирования JSON:", err)
+		}
+		ids = append(ids, task.ID)
+
+		resp, err = http.Post(server.URL+"/internal/task/"+string(task.ID)+"/return", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		utils.CloseResponseBody(resp.Body)
+		checkStatusCode(t, resp, http.StatusNoContent)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("После возврата выдана задача %s, ожидалась %s", ids[1], ids[0])
+	}
+}
+
+func TestAdminTimings(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.AdminToken = "admin-token"
+	cfg.TimingsFile = filepath.Join(t.TempDir(), "timings.json")
+	server := startTestServerWithConfig(cfg)
+	defer server.Close()
+
+	adminRequest := func(method, token, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+"/api/v1/admin/timings", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, token := range []string{"", "wrong-token"} {
+		resp := adminRequest(http.MethodGet, token, "")
+		utils.CloseResponseBody(resp.Body)
+		checkStatusCode(t, resp, http.StatusUnauthorized)
+		if resp.Header.Get("WWW-Authenticate") == "" {
+			t.Error("Ответ 401 без заголовка WWW-Authenticate")
+		}
+	}
+
+	resp := adminRequest(http.MethodPut, "admin-token", `{"multiplication_ms": -1}`)
+	utils.CloseResponseBody(resp.Body)
+	checkStatusCode(t, resp, http.StatusUnprocessableEntity)
+
+	resp = adminRequest(http.MethodPut, "admin-token", `{"addition_ms": 250}`)
+	var result struct {
+		Timings models.OperationTimings `json:"timings"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&result)
+	utils.CloseResponseBody(resp.Body)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	checkStatusCode(t, resp, http.StatusOK)
+	expected := models.OperationTimings{AdditionMs: 250, SubtractionMs: 100, MultiplicationMs: 100, DivisionMs: 100}
+	if result.Timings != expected {
+		t.Errorf("Получены тайминги %+v, ожидались %+v", result.Timings, expected)
+	}
+
+	saved, err := os.ReadFile(cfg.TimingsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var persisted models.OperationTimings
+	if err := json.Unmarshal(saved, &persisted); err != nil || persisted != expected {
+		t.Errorf("В файл сохранены тайминги %s, ожидались %+v", saved, expected)
+	}
+
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "2 + 3"})
+	resp, err = http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+	resp, err = http.Get(server.URL + "/internal/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var task models.TaskResponse
+	err = json.NewDecoder(resp.Body).Decode(&task)
+	utils.CloseResponseBody(resp.Body)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	if task.OperationTime != 250 {
+		t.Errorf("Новая задача получила время %d, ожидалось 250", task.OperationTime)
+	}
+}
+
+func TestQueueDepthHeader(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "1 + 2 + 3 * 4"})
+	resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.CloseResponseBody(resp.Body)
+
+	// после выдачи одной из двух готовых задач в очереди остаётся одна
+	for _, expected := range []string{"1", "0", "0"} {
+		resp, err = http.Get(server.URL + "/internal/task")
+		if err != nil {
+			t.Fatal(err)
+		}
+		utils.CloseResponseBody(resp.Body)
+		if depth := resp.Header.Get(models.QueueDepthHeader); depth != expected {
+			t.Errorf("Заголовок %s = %q, ожидалось %q", models.QueueDepthHeader, depth, expected)
+		}
+	}
+}
+
+func TestTaskBatches(t *testing.T) {
+	server := startTestServer()
+	defer server.Close()
+
+	requestBody, _ := json.Marshal(models.ExpressionRequest{Expression: "2 * 3 + 4 * 5"})
+	resp, err := http.Post(server.URL+"/api/v1/calculate", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created map[string]map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	utils.CloseResponseBody(resp.Body)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+
+	for _, max := range []string{"0", "abc", "101"} {
+		resp, err = http.Get(server.URL + "/internal/task?max=" + max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		utils.CloseResponseBody(resp.Body)
+		checkStatusCode(t, resp, http.StatusUnprocessableEntity)
+	}
+
+	resp, err = http.Get(server.URL + "/internal/task?max=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch models.TaskBatch
+	err = json.NewDecoder(resp.Body).Decode(&batch)
+	utils.CloseResponseBody(resp.Body)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	if len(batch.Tasks) != 2 {
+		t.Fatalf("Получено %d задач, ожидалось 2 готовых умножения", len(batch.Tasks))
+	}
+	unknownID := models.NewID()
+	results := []models.TaskResult{{TaskID: unknownID, Result: 1}}
+	for _, task := range batch.Tasks {
+		if task.TraceParent == "" {
+			t.Errorf("Задача %s выдана без traceparent", task.ID)
+		}
+		result, _ := calc.Compute(task.Arg1, task.Arg2, task.Operation)
+		results = append(results, models.TaskResult{TaskID: task.ID, Result: result})
+	}
+
+	requestBody, _ = json.Marshal(results)
+	resp, err = http.Post(server.URL+"/internal/task", "application/json", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var confirmation models.ResultBatchResponse
+	err = json.NewDecoder(resp.Body).Decode(&confirmation)
+	utils.CloseResponseBody(resp.Body)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	checkStatusCode(t, resp, http.StatusOK)
+	if len(confirmation.Accepted) != 2 || len(confirmation.Rejected) != 1 || confirmation.Rejected[0] != unknownID {
+		t.Errorf("Подтверждение %+v, ожидалось 2 принятых и отклонённый %s", confirmation, unknownID)
+	}
+
+	// одиночные задачи работают вместе с пакетными
+	drainTasks(t, server)
+	resp, err = http.Get(server.URL + "/api/v1/expressions/" + created["expression"]["id"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]models.Expression
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	utils.CloseResponseBody(resp.Body)
+	if err != nil {
+		t.Fatal("Ошибка декодирования JSON:", err)
+	}
+	if expression := response["expression"]; expression.Result != 26 {
+		t.Errorf("Результат выражения %v, ожидалось 26", expression.Result)
+	}
+}
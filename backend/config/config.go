@@ -1,46 +1,409 @@
 package config
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	TimeAdditionMs        int
-	TimeSubtractionMs     int
-	TimeMultiplicationsMs int
-	TimeDivisionsMs       int
-	ComputingPower        int
-	OrchestratorUrl       string
+	ListenAddr             string
+	TimeAdditionMs         int
+	TimeSubtractionMs      int
+	TimeMultiplicationsMs  int
+	TimeDivisionsMs        int
+	ComputingPower         int
+	OrchestratorUrl        string
+	WebhookSecret          string
+	WebhookMaxAttempts     int
+	WebhookBackoffMs       int
+	ResultCacheSize        int
+	ResultCacheTTLMs       int
+	OptimizeExpressions    bool
+	UserWeights            map[string]int
+	MaxLeasedPerExpr       int
+	PriorityAgingMs        int
+	MaxBacklog             int
+	RetentionMaxAgeMs      int
+	RetentionMaxPerUser    int
+	JanitorIntervalMs      int
+	AgentMetricsAddr       string
+	TraceFile              string
+	LogLevel               string
+	StateFile              string
+	ShutdownTimeoutMs      int
+	TaskDrainTimeoutMs     int
+	TaskLeaseTimeoutMs     int
+	AdminToken             string
+	TimingsFile            string
+	AgentMinWorkers        int
+	AgentMaxWorkers        int
+	AgentScaleIntervalMs   int
+	AgentPollMinMs         int
+	AgentPollMaxMs         int
+	AgentBreakerThreshold  int
+	AgentBreakerCooldownMs int
+	AgentResultAttempts    int
+	AgentOutboxSize        int
+	AgentBatchSize         int
 }
 
-func LoadConfig() *Config {
+// MaxBatchSize bounds agent_batch_size, and so the tasks the orchestrator
+// hands out and the results it accepts in a single request.
+const MaxBatchSize = 100
+
+// Default returns the configuration used when nothing overrides it.
+func Default() *Config {
 	return &Config{
-		TimeAdditionMs:        getEnvAsInt("TIME_ADDITION_MS", 1000),
-		TimeSubtractionMs:     getEnvAsInt("TIME_SUBTRACTION_MS", 1000),
-		TimeMultiplicationsMs: getEnvAsInt("TIME_MULTIPLICATIONS_MS", 1000),
-		TimeDivisionsMs:       getEnvAsInt("TIME_DIVISIONS_MS", 1000),
-		ComputingPower:        getEnvAsInt("COMPUTING_POWER", 5),
-		OrchestratorUrl:       getEnv("ORCHESTRATOR_URL", "http://localhost:8080"),
+		ListenAddr:             ":8080",
+		TimeAdditionMs:         1000,
+		TimeSubtractionMs:      1000,
+		TimeMultiplicationsMs:  1000,
+		TimeDivisionsMs:        1000,
+		ComputingPower:         5,
+		OrchestratorUrl:        "http://localhost:8080",
+		WebhookMaxAttempts:     5,
+		WebhookBackoffMs:       500,
+		ResultCacheSize:        1024,
+		UserWeights:            make(map[string]int),
+		PriorityAgingMs:        5000,
+		MaxBacklog:             100000,
+		RetentionMaxAgeMs:      24 * 60 * 60 * 1000,
+		RetentionMaxPerUser:    1000,
+		JanitorIntervalMs:      60 * 1000,
+		AgentMetricsAddr:       ":9090",
+		LogLevel:               "info",
+		ShutdownTimeoutMs:      10 * 1000,
+		TaskDrainTimeoutMs:     30 * 1000,
+		TaskLeaseTimeoutMs:     60 * 1000,
+		AgentScaleIntervalMs:   1000,
+		AgentPollMinMs:         100,
+		AgentPollMaxMs:         5000,
+		AgentBreakerThreshold:  5,
+		AgentBreakerCooldownMs: 10 * 1000,
+		AgentResultAttempts:    3,
+		AgentOutboxSize:        1000,
+		AgentBatchSize:         1,
+	}
+}
+
+// setting binds a Config field to its key in the config file, its
+// command-line flag (the key with dashes) and its environment variable.
+type setting struct {
+	key   string
+	env   string
+	usage string
+	value any
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"listen_addr", "LISTEN_ADDR", "address the orchestrator listens on", &c.ListenAddr},
+		{"time_addition_ms", "TIME_ADDITION_MS", "duration of an addition in ms", &c.TimeAdditionMs},
+		{"time_subtraction_ms", "TIME_SUBTRACTION_MS", "duration of a subtraction in ms", &c.TimeSubtractionMs},
+		{"time_multiplications_ms", "TIME_MULTIPLICATIONS_MS", "duration of a multiplication in ms", &c.TimeMultiplicationsMs},
+		{"time_divisions_ms", "TIME_DIVISIONS_MS", "duration of a division in ms", &c.TimeDivisionsMs},
+		{"computing_power", "COMPUTING_POWER", "number of agent workers", &c.ComputingPower},
+		{"orchestrator_url", "ORCHESTRATOR_URL", "orchestrator URL used by agents", &c.OrchestratorUrl},
+		{"webhook_secret", "WEBHOOK_SECRET", "key signing completion webhooks", &c.WebhookSecret},
+		{"webhook_max_attempts", "WEBHOOK_MAX_ATTEMPTS", "webhook delivery attempts", &c.WebhookMaxAttempts},
+		{"webhook_backoff_ms", "WEBHOOK_BACKOFF_MS", "initial delay between webhook attempts in ms", &c.WebhookBackoffMs},
+		{"result_cache_size", "RESULT_CACHE_SIZE", "result cache entries, 0 disables the cache", &c.ResultCacheSize},
+		{"result_cache_ttl_ms", "RESULT_CACHE_TTL_MS", "result cache entry lifetime in ms, 0 means forever", &c.ResultCacheTTLMs},
+		{"optimize_expressions", "OPTIMIZE_EXPRESSIONS", "simplify every expression before computing it", &c.OptimizeExpressions},
+		{"user_weights", "USER_WEIGHTS", "fair scheduling weights, e.g. alice:3,bob:1", &c.UserWeights},
+		{"max_leased_per_expression", "MAX_LEASED_PER_EXPRESSION", "leased tasks per expression, 0 means no limit", &c.MaxLeasedPerExpr},
+		{"priority_aging_ms", "PRIORITY_AGING_MS", "wait after which a task gains a priority level in ms", &c.PriorityAgingMs},
+		{"max_backlog", "MAX_BACKLOG", "unfinished tasks before submissions are rejected, 0 means no limit", &c.MaxBacklog},
+		{"retention_max_age_ms", "RETENTION_MAX_AGE_MS", "finished expression lifetime in ms, 0 means forever", &c.RetentionMaxAgeMs},
+		{"retention_max_per_user", "RETENTION_MAX_PER_USER", "finished expressions kept per user, 0 means no limit", &c.RetentionMaxPerUser},
+		{"janitor_interval_ms", "JANITOR_INTERVAL_MS", "interval between retention runs in ms, 0 disables them", &c.JanitorIntervalMs},
+		{"agent_metrics_addr", "AGENT_METRICS_ADDR", "address of the agent metrics endpoint, empty disables it", &c.AgentMetricsAddr},
+		{"trace_file", "TRACE_FILE", "file receiving finished trace spans", &c.TraceFile},
+		{"log_level", "LOG_LEVEL", "debug, info, warn or error", &c.LogLevel},
+		{"state_file", "STATE_FILE", "file the orchestrator state is saved to on shutdown", &c.StateFile},
+		{"shutdown_timeout_ms", "SHUTDOWN_TIMEOUT_MS", "time to finish requests and tasks on shutdown in ms", &c.ShutdownTimeoutMs},
+		{"task_drain_timeout_ms", "TASK_DRAIN_TIMEOUT_MS", "time to wait for leased tasks on shutdown in ms", &c.TaskDrainTimeoutMs},
+		{"task_lease_timeout_ms", "TASK_LEASE_TIMEOUT_MS", "time a task stays leased beyond its operation time before it is queued again in ms, 0 means forever", &c.TaskLeaseTimeoutMs},
+		{"admin_token", "ADMIN_TOKEN", "bearer token of the admin API, empty disables it", &c.AdminToken},
+		{"timings_file", "TIMINGS_FILE", "file operation timings changed through the admin API are saved to", &c.TimingsFile},
+		{"agent_min_workers", "AGENT_MIN_WORKERS", "fewest agent workers, 0 means computing_power", &c.AgentMinWorkers},
+		{"agent_max_workers", "AGENT_MAX_WORKERS", "most agent workers, 0 means computing_power", &c.AgentMaxWorkers},
+		{"agent_scale_interval_ms", "AGENT_SCALE_INTERVAL_MS", "interval between agent pool scaling decisions in ms", &c.AgentScaleIntervalMs},
+		{"agent_poll_min_ms", "AGENT_POLL_MIN_MS", "first agent poll delay after an empty queue or an error in ms", &c.AgentPollMinMs},
+		{"agent_poll_max_ms", "AGENT_POLL_MAX_MS", "longest agent poll delay in ms", &c.AgentPollMaxMs},
+		{"agent_breaker_threshold", "AGENT_BREAKER_THRESHOLD", "orchestrator failures before agents pause polling, 0 disables it", &c.AgentBreakerThreshold},
+		{"agent_breaker_cooldown_ms", "AGENT_BREAKER_COOLDOWN_MS", "pause after the failure threshold in ms", &c.AgentBreakerCooldownMs},
+		{"agent_result_attempts", "AGENT_RESULT_ATTEMPTS", "attempts to post a result before it is kept in the outbox", &c.AgentResultAttempts},
+		{"agent_outbox_size", "AGENT_OUTBOX_SIZE", "results kept while the orchestrator is unavailable, 0 drops them", &c.AgentOutboxSize},
+		{"agent_batch_size", "AGENT_BATCH_SIZE", "tasks fetched and results posted per request, 1 disables batches", &c.AgentBatchSize},
 	}
 }
 
-func getEnvAsInt(key string, defaultValue int) int {
-	valueStr, exists := os.LookupEnv(key)
-	if !exists {
-		return defaultValue
+func flagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+// Options are the command-line switches that are not configuration values.
+type Options struct {
+	ConfigFile  string
+	PrintConfig bool
+}
+
+// LoadConfig reads the configuration from the process arguments and environment.
+func LoadConfig() (*Config, *Options, error) {
+	return Load(os.Args[1:], os.LookupEnv)
+}
+
+// Load builds the configuration from, in increasing precedence, the defaults,
+// the YAML file named by --config or CONFIG_FILE, environment variables and
+// command-line flags, and validates the result.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, *Options, error) {
+	options := &Options{}
+	flagged := Default()
+	flags := flag.NewFlagSet("calc", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&options.ConfigFile, "config", "", "YAML configuration file")
+	flags.BoolVar(&options.PrintConfig, "print-config", false, "print the effective configuration and exit")
+	for _, s := range flagged.settings() {
+		flags.Var(fieldValue{s.value}, flagName(s.key), s.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			flags.SetOutput(os.Stderr)
+			flags.PrintDefaults()
+		}
+		return nil, nil, err
+	}
+	if options.ConfigFile == "" {
+		options.ConfigFile, _ = lookupEnv("CONFIG_FILE")
+	}
+
+	cfg := Default()
+	if options.ConfigFile != "" {
+		if err := cfg.loadFile(options.ConfigFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	// an empty variable counts as unset, as compose passes ${VAR} of a
+	// missing .env entry
+	for _, s := range cfg.settings() {
+		if value, exists := lookupEnv(s.env); exists && value != "" {
+			if err := setValue(s.value, value); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range cfg.settings() {
+			if flagName(s.key) == f.Name {
+				flagErr = errors.Join(flagErr, setValue(s.value, f.Value.String()))
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
 	}
-	value, err := strconv.ParseInt(valueStr, 10, 64)
+	return cfg, options, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return defaultValue
+		return err
+	}
+	var values map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	settings := make(map[string]setting)
+	for _, s := range c.settings() {
+		settings[s.key] = s
+	}
+	for key, node := range values {
+		s, known := settings[key]
+		if !known {
+			return fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		if err := node.Decode(s.value); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+	}
+	return nil
+}
+
+// Validate reports every invalid value at once.
+func (c *Config) Validate() error {
+	var errs []error
+	for _, s := range c.settings() {
+		if value, isInt := s.value.(*int); isInt && *value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %d", s.key, *value))
+		}
+	}
+	if c.ComputingPower < 1 {
+		errs = append(errs, fmt.Errorf("computing_power must be at least 1, got %d", c.ComputingPower))
+	}
+	if minWorkers, maxWorkers := c.WorkerLimits(); minWorkers > maxWorkers {
+		errs = append(errs, fmt.Errorf("agent_min_workers %d is above agent_max_workers %d", minWorkers, maxWorkers))
+	}
+	if c.AgentPollMinMs < 1 {
+		errs = append(errs, fmt.Errorf("agent_poll_min_ms must be at least 1, got %d", c.AgentPollMinMs))
+	}
+	if c.AgentPollMinMs > c.AgentPollMaxMs {
+		errs = append(errs, fmt.Errorf("agent_poll_min_ms %d is above agent_poll_max_ms %d", c.AgentPollMinMs, c.AgentPollMaxMs))
+	}
+	if c.AgentResultAttempts < 1 {
+		errs = append(errs, fmt.Errorf("agent_result_attempts must be at least 1, got %d", c.AgentResultAttempts))
+	}
+	if c.AgentBatchSize < 1 || c.AgentBatchSize > MaxBatchSize {
+		errs = append(errs, fmt.Errorf("agent_batch_size must be between 1 and %d, got %d", MaxBatchSize, c.AgentBatchSize))
+	}
+	if c.WebhookMaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("webhook_max_attempts must be at least 1, got %d", c.WebhookMaxAttempts))
+	}
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("listen_addr must not be empty"))
+	}
+	if parsed, err := url.Parse(c.OrchestratorUrl); err != nil || parsed.Host == "" {
+		errs = append(errs, fmt.Errorf("orchestrator_url %q is not an absolute URL", c.OrchestratorUrl))
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log_level must be debug, info, warn or error, got %q", c.LogLevel))
+	}
+	for user, weight := range c.UserWeights {
+		if weight < 1 {
+			errs = append(errs, fmt.Errorf("user_weights: weight of %q must be at least 1, got %d", user, weight))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WorkerLimits returns the bounds of the agent worker pool. Unset bounds
+// default to ComputingPower, which keeps the pool at a fixed size.
+func (c *Config) WorkerLimits() (minWorkers, maxWorkers int) {
+	minWorkers, maxWorkers = c.AgentMinWorkers, c.AgentMaxWorkers
+	if minWorkers == 0 {
+		minWorkers = min(c.ComputingPower, max(maxWorkers, 1))
+	}
+	if maxWorkers == 0 {
+		maxWorkers = max(c.ComputingPower, minWorkers)
+	}
+	return minWorkers, maxWorkers
+}
+
+// WriteYAML writes the configuration in the config file format with the
+// secrets masked.
+func (c *Config) WriteYAML(w io.Writer) error {
+	masked := *c
+	for _, secret := range []*string{&masked.WebhookSecret, &masked.AdminToken} {
+		if *secret != "" {
+			*secret = "********"
+		}
+	}
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range masked.settings() {
+		value := &yaml.Node{}
+		if err := value.Encode(s.value); err != nil {
+			return err
+		}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: s.key}, value)
+	}
+	encoder := yaml.NewEncoder(w)
+	defer encoder.Close()
+	return encoder.Encode(root)
+}
+
+// fieldValue adapts a pointer to a Config field to flag.Value.
+type fieldValue struct {
+	value any
+}
+
+func (v fieldValue) String() string {
+	switch value := v.value.(type) {
+	case *int:
+		return strconv.Itoa(*value)
+	case *bool:
+		return strconv.FormatBool(*value)
+	case *string:
+		return *value
+	case *map[string]int:
+		return formatWeights(*value)
+	}
+	return ""
+}
+
+func (v fieldValue) Set(s string) error {
+	return setValue(v.value, s)
+}
+
+func (v fieldValue) IsBoolFlag() bool {
+	_, isBool := v.value.(*bool)
+	return isBool
+}
+
+func setValue(target any, s string) error {
+	switch value := target.(type) {
+	case *int:
+		parsed, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", s)
+		}
+		*value = parsed
+	case *bool:
+		parsed, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", s)
+		}
+		*value = parsed
+	case *string:
+		*value = s
+	case *map[string]int:
+		parsed, err := parseWeights(s)
+		if err != nil {
+			return err
+		}
+		*value = parsed
+	}
+	return nil
+}
+
+// parseWeights parses a list like "alice:3,bob:1".
+func parseWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, weightStr, found := strings.Cut(strings.TrimSpace(pair), ":")
+		weight, err := strconv.Atoi(weightStr)
+		if !found || err != nil {
+			return nil, fmt.Errorf("%q is not a user:weight pair", pair)
+		}
+		weights[name] = weight
 	}
-	return int(value)
+	return weights, nil
 }
 
-func getEnv(key string, defaultValue string) string {
-	value, exists := os.LookupEnv(key)
-	if !exists {
-		return defaultValue
+func formatWeights(weights map[string]int) string {
+	pairs := make([]string, 0, len(weights))
+	for name, weight := range weights {
+		pairs = append(pairs, name+":"+strconv.Itoa(weight))
 	}
-	return value
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
 }
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func env(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, exists := values[key]
+		return value, exists
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, options, err := Load(nil, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddr != ":8080" || cfg.ComputingPower != 5 || cfg.TimeAdditionMs != 1000 || options.PrintConfig {
+		t.Errorf("unexpected defaults %+v, %+v", cfg, options)
+	}
+}
+
+func TestLoadIgnoresEmptyEnv(t *testing.T) {
+	cfg, _, err := Load(nil, env(map[string]string{"COMPUTING_POWER": "", "TIME_ADDITION_MS": ""}))
+	if err != nil {
+		t.Fatalf("Load() with empty variables error = %v", err)
+	}
+	if cfg.ComputingPower != 5 || cfg.TimeAdditionMs != 1000 {
+		t.Errorf("empty variables changed the configuration to %+v", cfg)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calc.yaml")
+	file := "time_addition_ms: 10\ntime_subtraction_ms: 20\ntime_divisions_ms: 30\nuser_weights:\n  alice: 3\n"
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, _, err := Load(
+		[]string{"--time-divisions-ms", "300", "--optimize-expressions"},
+		env(map[string]string{"CONFIG_FILE": path, "TIME_SUBTRACTION_MS": "200", "TIME_DIVISIONS_MS": "250"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// file over defaults, env over file, flags over env
+	if cfg.TimeAdditionMs != 10 || cfg.TimeSubtractionMs != 200 || cfg.TimeDivisionsMs != 300 ||
+		cfg.TimeMultiplicationsMs != 1000 || !cfg.OptimizeExpressions || cfg.UserWeights["alice"] != 3 {
+		t.Errorf("unexpected configuration %+v", cfg)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calc.yaml")
+	if err := os.WriteFile(path, []byte("unknown_setting: 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		message string
+	}{
+		{"unparsable env", nil, map[string]string{"TIME_ADDITION_MS": "fast"}, "TIME_ADDITION_MS"},
+		{"negative timing", []string{"--time-addition-ms=-1"}, nil, "time_addition_ms must not be negative"},
+		{"zero computing power", nil, map[string]string{"COMPUTING_POWER": "0"}, "computing_power must be at least 1"},
+		{"malformed weights", nil, map[string]string{"USER_WEIGHTS": "alice"}, "user:weight"},
+		{"unknown flag", []string{"--unknown"}, nil, "unknown"},
+		{"unknown file setting", []string{"--config", path}, nil, "unknown setting"},
+		{"invalid log level", []string{"--log-level", "verbose"}, nil, "log_level"},
+		{"worker bounds reversed", nil, map[string]string{"AGENT_MIN_WORKERS": "5", "AGENT_MAX_WORKERS": "2"}, "agent_min_workers 5 is above"},
+		{"batch size above the limit", nil, map[string]string{"AGENT_BATCH_SIZE": "101"}, "agent_batch_size must be between 1 and 100"},
+	}
+	for _, test := range tests {
+		_, _, err := Load(test.args, env(test.env))
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: Load() error = %v, expected it to mention %q", test.name, err, test.message)
+		}
+	}
+}
+
+func TestWriteYAMLRoundTrip(t *testing.T) {
+	cfg, options, err := Load(
+		[]string{"--print-config", "--webhook-secret", "secret", "--user-weights", "bob:2,alice:1"},
+		env(nil),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !options.PrintConfig {
+		t.Error("--print-config was not recognized")
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.WriteYAML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "webhook_secret: '********'\n") {
+		t.Errorf("webhook secret is not masked:\n%s", buf.String())
+	}
+
+	path := filepath.Join(t.TempDir(), "printed.yaml")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, _, err := Load([]string{"--config", path}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.UserWeights["bob"] != 2 || reloaded.ListenAddr != cfg.ListenAddr {
+		t.Errorf("printed configuration does not load back: %+v", reloaded)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calc.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := []string{"--config", path}
+	write("time_addition_ms: 10\nadmin_token: old\n")
+	current, _, err := Load(args, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("time_addition_ms: 20\nlog_level: debug\nadmin_token: old\n")
+	updated, changes, err := Reload(current, args, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{{"time_addition_ms", "10", "20"}, {"log_level", "info", "debug"}}
+	if updated.TimeAdditionMs != 20 || len(changes) != len(expected) {
+		t.Fatalf("Reload() = %+v, changes %+v, expected %+v", updated, changes, expected)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("change %d = %+v, expected %+v", i, changes[i], expected[i])
+		}
+	}
+
+	write("time_addition_ms: 20\nlisten_addr: ':9000'\nadmin_token: new\n")
+	_, changes, err = Reload(current, args, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "listen_addr, admin_token cannot be changed without a restart") {
+		t.Errorf("Reload() error = %v, expected the listen address and admin token to be rejected", err)
+	}
+	for _, change := range changes {
+		if change.Key == "admin_token" && (change.Old != "********" || change.New != "********") {
+			t.Errorf("admin token change %+v is not masked", change)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// reloadable lists the settings a running process applies when its
+// configuration is reloaded. Any other change needs a restart.
+var reloadable = map[string]bool{
+	"time_addition_ms":          true,
+	"time_subtraction_ms":       true,
+	"time_multiplications_ms":   true,
+	"time_divisions_ms":         true,
+	"max_backlog":               true,
+	"max_leased_per_expression": true,
+	"task_lease_timeout_ms":     true,
+	"log_level":                 true,
+	"computing_power":           true,
+	"agent_min_workers":         true,
+	"agent_max_workers":         true,
+}
+
+// secrets are the settings whose values are never printed.
+var secrets = map[string]bool{
+	"webhook_secret": true,
+	"admin_token":    true,
+}
+
+// Change is a setting whose value differs between two configurations.
+type Change struct {
+	Key string
+	Old string
+	New string
+}
+
+// Diff returns the settings of updated that differ from current, in the
+// order of the settings table.
+func Diff(current, updated *Config) []Change {
+	var changes []Change
+	updatedSettings := updated.settings()
+	for i, s := range current.settings() {
+		old, value := fieldValue{s.value}.String(), fieldValue{updatedSettings[i].value}.String()
+		if old == value {
+			continue
+		}
+		if secrets[s.key] {
+			old, value = "********", "********"
+		}
+		changes = append(changes, Change{Key: s.key, Old: old, New: value})
+	}
+	return changes
+}
+
+// Reload loads the configuration again like Load and returns it with its
+// changes from current. If a setting that is not reloadable changed, the
+// new configuration is rejected.
+func Reload(current *Config, args []string, lookupEnv func(string) (string, bool)) (*Config, []Change, error) {
+	updated, _, err := Load(args, lookupEnv)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes := Diff(current, updated)
+	var unsafe []string
+	for _, change := range changes {
+		if !reloadable[change.Key] {
+			unsafe = append(unsafe, change.Key)
+		}
+	}
+	if len(unsafe) > 0 {
+		return nil, changes, fmt.Errorf("%s cannot be changed without a restart", strings.Join(unsafe, ", "))
+	}
+	return updated, changes, nil
+}
+
+// ReloadConfig reloads the configuration from the process arguments and
+// environment.
+func ReloadConfig(current *Config) (*Config, []Change, error) {
+	return Reload(current, os.Args[1:], os.LookupEnv)
+}
+
+// WatchReload reloads the configuration on every SIGHUP until ctx is done.
+// Accepted configurations are logged setting by setting and passed to apply;
+// rejected ones are logged and the running configuration is kept.
+func WatchReload(ctx context.Context, current *Config, apply func(*Config, []Change)) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+		updated, changes, err := ReloadConfig(current)
+		if err != nil {
+			slog.Error("configuration reload rejected", "error", err)
+			continue
+		}
+		for _, change := range changes {
+			slog.Info("setting changed", "key", change.Key, "from", change.Old, "to", change.New)
+		}
+		slog.Info("configuration reloaded", "changes", len(changes))
+		apply(updated, changes)
+		current = updated
+	}
+}
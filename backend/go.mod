@@ -5,4 +5,5 @@ go 1.23
 require (
 	github.com/google/uuid v1.6.0
 	github.com/rs/cors v1.11.1
-)
\ No newline at end of file
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -1,67 +1,202 @@
 package agent
 
 import (
-	"bytes"
 	"calc-website/config"
 	"calc-website/internal/models"
 	"calc-website/pkg/calc"
+	"calc-website/pkg/tracing"
 	"calc-website/pkg/utils"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
 )
 
-func ProcessTask(orchestratorUrl string) error {
-	taskUrl := orchestratorUrl + "/internal/task"
-	resp, err := http.Get(taskUrl)
+var tracer = tracing.NewTracer("agent", tracing.NopExporter{})
+
+var (
+	// ErrNoTasks is returned by ProcessTask when no task is ready.
+	ErrNoTasks = errors.New("no tasks")
+	// ErrUnavailable wraps failures to reach the orchestrator, as opposed to
+	// failures of the task itself.
+	ErrUnavailable = errors.New("orchestrator unavailable")
+)
+
+// ProcessTask fetches one task, computes it and posts the result once. If
+// ctx is done before the computation finishes, the task is returned to the
+// orchestrator instead.
+func ProcessTask(ctx context.Context, orchestratorUrl string, agentID string) error {
+	results := &outbox{taskUrl: orchestratorUrl + "/internal/task", attempts: 1}
+	return processTask(ctx, results, agentID)
+}
+
+// processTask is ProcessTask delivering the result through results.
+func processTask(ctx context.Context, results *outbox, agentID string) error {
+	// a task leased by a poll cut short would wait for its lease to expire
+	tasks, err := fetchTasks(context.WithoutCancel(ctx), results.taskUrl, agentID, 1, 0)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil
+	pending, err := computeTask(ctx, results.taskUrl, tasks[0], agentID)
+	if pending == nil {
+		return err
+	}
+	if sendErr := results.Send(ctx, *pending); sendErr != nil {
+		return sendErr
 	}
+	return err
+}
 
-	body, err := io.ReadAll(resp.Body)
-	defer utils.CloseResponseBody(resp.Body)
+// fetchTasks polls the orchestrator for ready tasks on behalf of workers.
+// With max above 0 it asks for a batch of up to max tasks, otherwise for a
+// single task.
+func fetchTasks(ctx context.Context, taskUrl string, agentID string, workers int, max int) ([]*models.TaskResponse, error) {
+	pollUrl := taskUrl
+	if max > 0 {
+		pollUrl += "?max=" + strconv.Itoa(max)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pollUrl, nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	req.Header.Set(models.AgentIDHeader, agentID)
+	if workers > 1 {
+		req.Header.Set(models.AgentWorkersHeader, strconv.Itoa(workers))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	if queued, err := strconv.Atoi(resp.Header.Get(models.QueueDepthHeader)); err == nil {
+		queueDepth.Set(float64(queued))
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrNoTasks
+	default:
+		return nil, fmt.Errorf("%w: get task: %s", ErrUnavailable, resp.Status)
 	}
 
-	var task models.TaskResponse
-	err = json.Unmarshal(body, &task)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if max > 0 {
+		var batch models.TaskBatch
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, err
+		}
+		if len(batch.Tasks) == 0 {
+			return nil, ErrNoTasks
+		}
+		return batch.Tasks, nil
+	}
+	var task models.TaskResponse
+	if err := json.Unmarshal(body, &task); err != nil {
+		return nil, err
+	}
+	if header := resp.Header.Get(tracing.Header); header != "" {
+		task.TraceParent = header
 	}
+	return []*models.TaskResponse{&task}, nil
+}
+
+// computeTask computes a task and returns its result. If ctx is done before
+// the operation time has passed, the task is returned to the orchestrator
+// and no result is returned.
+func computeTask(ctx context.Context, taskUrl string, task *models.TaskResponse, agentID string) (*pendingResult, error) {
+	parent, _ := tracing.Parse(task.TraceParent)
+	span := tracer.Start("compute "+task.Operation, parent)
+	span.SetAttribute("task_id", string(task.ID))
+	span.SetAttribute("agent_id", agentID)
+	defer span.End()
+	slog.Debug("task received", "task_id", task.ID, "agent_id", agentID, "operation", task.Operation)
+
+	start := time.Now()
+	busyWorkers.Add(1)
+	defer func() {
+		busyWorkers.Add(-1)
+		busySeconds.Add(time.Since(start).Seconds())
+	}()
 	result, err := calc.Compute(task.Arg1, task.Arg2, task.Operation)
 	if err != nil {
-		return err
+		tasksFailed.Inc(task.Operation)
+		span.SetAttribute("error", err.Error())
+		return &pendingResult{
+			result:      models.TaskResult{TaskID: task.ID, Error: errorCode(err), AgentID: agentID},
+			operation:   task.Operation,
+			traceParent: span.Context().String(),
+		}, fmt.Errorf("compute task %s: %w", task.ID, err)
+	}
+	select {
+	case <-time.After(time.Duration(task.OperationTime) * time.Millisecond):
+	case <-ctx.Done():
+		span.SetAttribute("returned", "true")
+		return nil, returnTask(taskUrl, task.ID, agentID)
 	}
-	time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
+	computeDuration.Observe(time.Since(start).Seconds(), task.Operation)
 
-	taskResult := models.TaskResult{
-		TaskID: task.ID,
-		Result: result,
+	return &pendingResult{
+		result:      models.TaskResult{TaskID: task.ID, Result: result, AgentID: agentID},
+		operation:   task.Operation,
+		traceParent: span.Context().String(),
+	}, nil
+}
+
+// errorCode maps a compute error to the code reported to the orchestrator.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, calc.ErrDivisionByZero):
+		return models.CodeDivisionByZero
+	case errors.Is(err, calc.ErrUnknownOperator):
+		return models.CodeUnknownOperator
+	default:
+		return models.CodeInternal
 	}
-	taskBytes, err := json.Marshal(taskResult)
+}
+
+// returnTask gives a leased task back to the orchestrator so another agent
+// can compute it.
+func returnTask(taskUrl string, taskID models.ID, agentID string) error {
+	req, err := http.NewRequest(http.MethodPost, taskUrl+"/"+string(taskID)+"/return", nil)
 	if err != nil {
 		return err
 	}
-	resp, err = http.Post(taskUrl, "application/json", bytes.NewBuffer(taskBytes))
+	req.Header.Set(models.AgentIDHeader, agentID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("return task %s: %w", taskID, err)
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("return task %s: %s", taskID, resp.Status)
+	}
+	slog.Info("task returned", "task_id", taskID, "agent_id", agentID)
 	return nil
 }
 
-func StartAgents(cfg *config.Config) {
-	for i := 0; i < cfg.ComputingPower; i++ {
-		go func() {
-			for {
-				err := ProcessTask(cfg.OrchestratorUrl)
-				if err != nil {
-					log.Printf("error by process task: %v", err.Error())
-				}
-				time.Sleep(time.Millisecond * 100)
-			}
-		}()
+// StartAgents runs cfg.ComputingPower workers, within cfg.WorkerLimits,
+// until ctx is done. A worker then finishes its current task, or returns it
+// to the orchestrator if that takes longer than cfg.ShutdownTimeoutMs. The
+// pool is resized every cfg.AgentScaleIntervalMs as the orchestrator queue
+// and the worker load change. Results the orchestrator does not accept
+// because it is unavailable are retried in the background.
+func StartAgents(ctx context.Context, cfg *config.Config) *Pool {
+	pool := NewPool(ctx, cfg)
+	pool.Resize(cfg.ComputingPower)
+	go pool.DeliverResults(ctx)
+	if cfg.AgentBatchSize > 1 {
+		pool.FetchBatches(ctx)
+	}
+	if cfg.AgentScaleIntervalMs > 0 {
+		go pool.Autoscale(ctx, time.Duration(cfg.AgentScaleIntervalMs)*time.Millisecond)
 	}
+	return pool
 }
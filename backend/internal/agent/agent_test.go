@@ -0,0 +1,277 @@
+package agent
+
+import (
+	"calc-website/config"
+	"calc-website/internal/models"
+	"calc-website/pkg/tracing"
+	"calc-website/pkg/utils"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProcessTaskMetrics(t *testing.T) {
+	tasks := []models.TaskResponse{
+		{ID: models.NewID(), Arg1: 2, Arg2: 3, Operation: "+"},
+		{ID: models.NewID(), Arg1: 2, Arg2: 0, Operation: "/"},
+	}
+	orchestrator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			return
+		}
+		if len(tasks) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(tasks[0])
+		tasks = tasks[1:]
+	}))
+	defer orchestrator.Close()
+
+	before := scrapeMetrics(t)
+	if err := ProcessTask(context.Background(), orchestrator.URL, "test"); err != nil {
+		t.Fatalf("ProcessTask() error = %v", err)
+	}
+	if err := ProcessTask(context.Background(), orchestrator.URL, "test"); err == nil {
+		t.Error("ProcessTask() did not report division by zero")
+	}
+	after := scrapeMetrics(t)
+
+	// the registry is shared by the package, so counters are compared with
+	// their values before the test
+	for sample, expected := range map[string]float64{
+		`calc_agent_tasks_total{operation="+"}`:           1,
+		`calc_agent_tasks_total{operation="/"}`:           0,
+		`calc_agent_tasks_failed_total{operation="/"}`:    1,
+		`calc_agent_compute_seconds_count{operation="+"}`: 1,
+	} {
+		if delta := after[sample] - before[sample]; delta != expected {
+			t.Errorf("%s increased by %v, expected %v", sample, delta, expected)
+		}
+	}
+	if busy := after["calc_agent_busy_workers"]; busy != 0 {
+		t.Errorf("calc_agent_busy_workers = %v, expected 0", busy)
+	}
+}
+
+// scrapeMetrics returns the samples served by MetricsHandler by name and labels.
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		separator := strings.LastIndex(line, " ")
+		if line == "" || strings.HasPrefix(line, "#") || separator < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[separator+1:], 64)
+		if err != nil {
+			t.Fatalf("sample %q: %v", line, err)
+		}
+		samples[line[:separator]] = value
+	}
+	return samples
+}
+
+func TestProcessTaskReportsFailure(t *testing.T) {
+	task := models.TaskResponse{ID: models.NewID(), Arg1: 2, Arg2: 0, Operation: "/"}
+	reported := make(chan models.TaskResult, 1)
+	orchestrator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var result models.TaskResult
+			_ = json.NewDecoder(r.Body).Decode(&result)
+			reported <- result
+			return
+		}
+		_ = json.NewEncoder(w).Encode(task)
+	}))
+	defer orchestrator.Close()
+
+	if err := ProcessTask(context.Background(), orchestrator.URL, "test"); err == nil {
+		t.Error("ProcessTask() did not report division by zero")
+	}
+	select {
+	case result := <-reported:
+		if result.TaskID != task.ID || result.Error != models.CodeDivisionByZero {
+			t.Errorf("reported %+v, expected task %s to fail with %s", result, task.ID, models.CodeDivisionByZero)
+		}
+	default:
+		t.Error("the failure was not reported to the orchestrator")
+	}
+}
+
+func TestProcessTaskPropagatesTrace(t *testing.T) {
+	exporter := &tracing.MemoryExporter{}
+	tracer = tracing.NewTracer("agent", exporter)
+	defer func() { tracer = tracing.NewTracer("agent", tracing.NopExporter{}) }()
+
+	taskContext := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	var posted string
+	orchestrator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			posted = r.Header.Get(tracing.Header)
+			return
+		}
+		w.Header().Set(tracing.Header, taskContext)
+		_ = json.NewEncoder(w).Encode(models.TaskResponse{ID: models.NewID(), Arg1: 2, Arg2: 3, Operation: "*"})
+	}))
+	defer orchestrator.Close()
+
+	if err := ProcessTask(context.Background(), orchestrator.URL, "test"); err != nil {
+		t.Fatalf("ProcessTask() error = %v", err)
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("exported %d spans, expected 1", len(spans))
+	}
+	span := spans[0]
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentID != "00f067aa0ba902b7" {
+		t.Errorf("compute span %+v is not a child of the task span", span)
+	}
+	if posted != "00-"+span.TraceID+"-"+span.SpanID+"-01" {
+		t.Errorf("result posted with traceparent %q, expected the compute span", posted)
+	}
+}
+
+func TestProcessTaskReturnsOnShutdown(t *testing.T) {
+	taskID := models.NewID()
+	returned := make(chan string, 1)
+	orchestrator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			returned <- r.URL.Path
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(models.TaskResponse{ID: taskID, Arg1: 2, Arg2: 3, Operation: "+", OperationTime: 60000})
+	}))
+	defer orchestrator.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ProcessTask(ctx, orchestrator.URL, "test"); err != nil {
+		t.Fatalf("ProcessTask() error = %v", err)
+	}
+	select {
+	case path := <-returned:
+		if path != "/internal/task/"+string(taskID)+"/return" {
+			t.Errorf("task returned to %s", path)
+		}
+	default:
+		t.Error("task was not returned to the orchestrator")
+	}
+}
+
+func TestPoolResize(t *testing.T) {
+	var mu sync.Mutex
+	polled := make(map[string]bool)
+	orchestrator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		polled[r.Header.Get(models.AgentIDHeader)] = true
+		mu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer orchestrator.Close()
+	pollers := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		count := len(polled)
+		clear(polled)
+		return count
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewPool(ctx, &config.Config{
+		OrchestratorUrl: orchestrator.URL, AgentMinWorkers: 1, AgentMaxWorkers: 5, AgentPollMinMs: 50, AgentPollMaxMs: 50,
+	})
+	pool.Resize(3)
+	time.Sleep(300 * time.Millisecond)
+	if count := pollers(); count != 3 || pool.Size() != 3 || workers.Value() != 3 {
+		t.Errorf("%d workers polled, size %d, expected 3", count, pool.Size())
+	}
+
+	pool.Resize(1)
+	time.Sleep(300 * time.Millisecond)
+	pollers()
+	time.Sleep(300 * time.Millisecond)
+	if count := pollers(); count != 1 || pool.Size() != 1 || workers.Value() != 1 {
+		t.Errorf("%d workers polled after shrinking, size %d, expected 1", count, pool.Size())
+	}
+
+	cancel()
+	pool.Wait()
+}
+
+func TestDesiredWorkers(t *testing.T) {
+	tests := []struct {
+		name                   string
+		size, busy, queued     int
+		minWorkers, maxWorkers int
+		expected               int
+	}{
+		{"busy with a backlog", 4, 4, 10, 1, 20, 8},
+		{"growth limited by the backlog", 4, 3, 2, 1, 20, 6},
+		{"growth limited by the maximum", 4, 4, 10, 1, 5, 5},
+		{"idle workers take the backlog", 4, 1, 10, 1, 20, 4},
+		{"idle without a backlog", 4, 1, 0, 1, 20, 3},
+		{"kept at the minimum", 2, 0, 0, 2, 20, 2},
+		{"busy without a backlog", 4, 4, 0, 1, 20, 4},
+		{"moved into new bounds", 10, 0, 5, 1, 6, 6},
+	}
+	for _, test := range tests {
+		got := desiredWorkers(test.size, test.busy, test.queued, test.minWorkers, test.maxWorkers)
+		if got != test.expected {
+			t.Errorf("%s: desiredWorkers() = %d, expected %d", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestCapacityHandler(t *testing.T) {
+	orchestrator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer orchestrator.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := NewPool(ctx, &config.Config{
+		OrchestratorUrl: orchestrator.URL, ComputingPower: 2, AgentPollMinMs: 50, AgentPollMaxMs: 50,
+	})
+	pool.Resize(2)
+	server := httptest.NewServer(CapacityHandler(pool, "admin-token"))
+	defer server.Close()
+
+	request := func(token, body string) (*http.Response, models.Capacity) {
+		req, _ := http.NewRequest(http.MethodPut, server.URL, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer utils.CloseResponseBody(resp.Body)
+		var capacity models.Capacity
+		_ = json.NewDecoder(resp.Body).Decode(&capacity)
+		return resp, capacity
+	}
+
+	if resp, _ := request("wrong-token", `{"max_workers": 4}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request with a wrong token answered %d", resp.StatusCode)
+	}
+	if resp, _ := request("admin-token", `{"min_workers": 5}`); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("minimum above the maximum answered %d", resp.StatusCode)
+	}
+	resp, capacity := request("admin-token", `{"min_workers": 3, "max_workers": 4}`)
+	expected := models.Capacity{MinWorkers: 3, MaxWorkers: 4, Workers: 3}
+	if resp.StatusCode != http.StatusOK || capacity != expected {
+		t.Errorf("PUT answered %d with %+v, expected %+v", resp.StatusCode, capacity, expected)
+	}
+
+	cancel()
+	pool.Wait()
+}
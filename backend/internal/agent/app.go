@@ -2,11 +2,73 @@ package agent
 
 import (
 	"calc-website/config"
-	"log"
+	"calc-website/pkg/logging"
+	"calc-website/pkg/tracing"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func Run(cfg *config.Config) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	StartAgents(cfg)
-	select {}
+	if err := logging.Setup(os.Stderr, cfg.LogLevel); err != nil {
+		slog.Warn("invalid log level, using info", "level", cfg.LogLevel)
+	}
+	exporter, err := tracing.NewExporter(cfg.TraceFile)
+	if err != nil {
+		slog.Error("open trace file error", "path", cfg.TraceFile, "error", err)
+		exporter = tracing.NopExporter{}
+	}
+	tracer = tracing.NewTracer("agent", exporter)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	running := StartAgents(ctx, cfg)
+	go config.WatchReload(ctx, cfg, func(updated *config.Config, changes []config.Change) {
+		if err := logging.SetLevel(updated.LogLevel); err != nil {
+			slog.Error("set log level error", "level", updated.LogLevel, "error", err)
+		}
+		for _, change := range changes {
+			switch change.Key {
+			case "computing_power", "agent_min_workers", "agent_max_workers":
+				running.SetCapacity(updated.WorkerLimits())
+				return
+			}
+		}
+	})
+
+	var server *http.Server
+	if cfg.AgentMetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", MetricsHandler())
+		mux.HandleFunc("/capacity", CapacityHandler(running, cfg.AdminToken))
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		server = &http.Server{Addr: cfg.AgentMetricsAddr, Handler: mux}
+		go func() {
+			err := server.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("metrics server stopped", "addr", cfg.AgentMetricsAddr, "error", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	slog.Info("shutting down, waiting for workers")
+	running.Wait()
+	if kept := running.FlushResults(); kept > 0 {
+		slog.Error("task results not delivered", "count", kept)
+	}
+	if server != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(),
+			time.Duration(cfg.ShutdownTimeoutMs)*time.Millisecond)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}
+	slog.Info("agent stopped")
 }
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// backoff spaces out polls of an empty queue or a failing orchestrator. The
+// delay doubles from min up to max and is jittered to half to full length,
+// so workers started together do not poll in lockstep. It is not safe for
+// concurrent use; each worker has its own.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+// Next returns the delay before the next poll and lengthens the following one.
+func (b *backoff) Next() time.Duration {
+	delay := b.max
+	if b.attempt < 32 && b.min<<b.attempt < b.max {
+		delay = b.min << b.attempt
+	}
+	b.attempt++
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Reset returns to the shortest delay once tasks flow again.
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
+
+// breaker stops every worker of a pool from polling an orchestrator that
+// keeps failing. After threshold consecutive failures it opens for
+// cooldown; then a single probe request is let through, and its outcome
+// closes the breaker or opens it again. A zero threshold disables it.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// Allow returns how long to wait before trying the orchestrator, or 0 if a
+// request may be sent now.
+func (b *breaker) Allow() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold == 0 || b.failures < b.threshold {
+		return 0
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return wait
+	}
+	if b.probing {
+		return b.cooldown
+	}
+	b.probing = true
+	return 0
+}
+
+// Success records a response from the orchestrator.
+func (b *breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold > 0 && b.failures >= b.threshold {
+		slog.Info("orchestrator reachable again, circuit breaker closed")
+		breakerOpen.Set(0)
+	}
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a failed request to the orchestrator.
+func (b *breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.threshold > 0 && b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			slog.Warn("orchestrator unavailable, circuit breaker opened",
+				"failures", b.failures, "cooldown", b.cooldown)
+			breakerOpen.Set(1)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
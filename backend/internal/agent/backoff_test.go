@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"calc-website/config"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: 100 * time.Millisecond, max: time.Second}
+	for _, ceiling := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		ceiling *= time.Millisecond
+		if delay := b.Next(); delay < ceiling/2 || delay > ceiling {
+			t.Errorf("Next() = %v, expected between %v and %v", delay, ceiling/2, ceiling)
+		}
+	}
+	b.Reset()
+	if delay := b.Next(); delay > 100*time.Millisecond {
+		t.Errorf("Next() after Reset() = %v, expected at most 100ms", delay)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{threshold: 2, cooldown: 50 * time.Millisecond}
+	b.Failure()
+	if wait := b.Allow(); wait != 0 {
+		t.Fatalf("Allow() = %v below the threshold, expected 0", wait)
+	}
+	b.Failure()
+	if wait := b.Allow(); wait <= 0 || breakerOpen.Value() != 1 {
+		t.Fatalf("Allow() = %v after the threshold, expected the breaker to be open", wait)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if wait := b.Allow(); wait != 0 {
+		t.Fatalf("Allow() = %v after the cooldown, expected a probe", wait)
+	}
+	if wait := b.Allow(); wait == 0 {
+		t.Error("a second request was allowed while the probe is running")
+	}
+	b.Failure()
+	if wait := b.Allow(); wait <= 0 {
+		t.Error("a failed probe did not open the breaker again")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	b.Allow()
+	b.Success()
+	if wait := b.Allow(); wait != 0 || breakerOpen.Value() != 0 {
+		t.Errorf("Allow() = %v after a successful probe, expected the breaker to be closed", wait)
+	}
+}
+
+func TestPoolBacksOffUnavailableOrchestrator(t *testing.T) {
+	var polls atomic.Int32
+	var available atomic.Bool
+	orchestrator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer orchestrator.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := NewPool(ctx, &config.Config{
+		OrchestratorUrl: orchestrator.URL, ComputingPower: 4, AgentPollMinMs: 10, AgentPollMaxMs: 20,
+		AgentBreakerThreshold: 3, AgentBreakerCooldownMs: 300,
+	})
+	pool.Resize(4)
+	time.Sleep(200 * time.Millisecond)
+	// the breaker opens after 3 failures; a few requests may already be in flight
+	if count := polls.Load(); count > 3+4 {
+		t.Errorf("%d polls of an unavailable orchestrator, expected the breaker to stop them", count)
+	}
+
+	available.Store(true)
+	time.Sleep(400 * time.Millisecond)
+	if breakerOpen.Value() != 0 || polls.Load() < 10 {
+		t.Errorf("%d polls after recovery, expected the breaker to close and polling to resume", polls.Load())
+	}
+
+	cancel()
+	pool.Wait()
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"bytes"
+	"calc-website/config"
+	"calc-website/internal/models"
+	"calc-website/internal/orchestrator"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolProcessesBatches(t *testing.T) {
+	service := orchestrator.NewAPIService(&config.Config{WebhookMaxAttempts: 1, WebhookSecret: "secret"})
+	router := orchestrator.NewAPIHandler(service).Router()
+	var singlePolls, batchPolls, batchPosts atomic.Int32
+	finished := make(chan models.Expression, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/webhook" {
+			var expression models.Expression
+			_ = json.NewDecoder(r.Body).Decode(&expression)
+			finished <- expression
+			return
+		}
+		if r.URL.Path == "/internal/task" {
+			switch {
+			case r.Method == http.MethodGet && r.URL.Query().Has("max"):
+				batchPolls.Add(1)
+			case r.Method == http.MethodGet:
+				singlePolls.Add(1)
+			case r.Method == http.MethodPost:
+				body, _ := io.ReadAll(r.Body)
+				if bytes.HasPrefix(body, []byte("[")) {
+					batchPosts.Add(1)
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+		}
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	expressionID, err := service.CreateTasks(context.Background(), &models.ExpressionRequest{
+		Expression:  "1 + 2 + 3 + 4 + 5 + 6 + 7 + 8",
+		Optimize:    true,
+		CallbackURL: server.URL + "/webhook",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewPool(ctx, &config.Config{
+		OrchestratorUrl: server.URL, ComputingPower: 4, AgentPollMinMs: 5, AgentPollMaxMs: 5,
+		AgentResultAttempts: 1, AgentOutboxSize: 10, AgentBatchSize: 10,
+	})
+	pool.Resize(4)
+	pool.FetchBatches(ctx)
+
+	select {
+	case expression := <-finished:
+		if expression.Result != 36 {
+			t.Errorf("expression finished as %+v, expected result 36", expression)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expression did not finish")
+	}
+	cancel()
+	pool.Wait()
+	polls := batchPolls.Load()
+	time.Sleep(20 * time.Millisecond)
+	if batchPolls.Load() != polls {
+		t.Error("the fetcher kept polling after Wait() returned")
+	}
+
+	if active := service.ActiveAgents(); active != 4 {
+		t.Errorf("ActiveAgents() = %d, expected the 4 workers behind the fetcher", active)
+	}
+	if singlePolls.Load() != 0 || batchPolls.Load() == 0 || batchPosts.Load() == 0 {
+		t.Errorf("%d single polls, %d batch polls, %d batch posts; expected only batches",
+			singlePolls.Load(), batchPolls.Load(), batchPosts.Load())
+	}
+	trace, err := service.GetExpressionTrace(expressionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range trace {
+		if task.AgentID == "" || strings.HasSuffix(task.AgentID, "/fetch") {
+			t.Errorf("task %s traced to %q, expected the worker that computed it", task.ID, task.AgentID)
+		}
+	}
+}
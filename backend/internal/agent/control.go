@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"calc-website/internal/models"
+	"calc-website/pkg/utils"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// CapacityHandler reports the capacity of pool on GET and changes its
+// bounds on PUT. Requests must carry adminToken as a bearer token; without
+// a token the handler refuses every request.
+func CapacityHandler(pool *Pool, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !utils.BearerTokenValid(r.Header.Get("Authorization"), adminToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, models.CodeUnauthorized, "unauthorized")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var update models.CapacityUpdate
+			decoder := json.NewDecoder(r.Body)
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&update); err != nil {
+				writeError(w, http.StatusUnprocessableEntity, models.CodeRequestInvalid, err.Error())
+				return
+			}
+			minWorkers, maxWorkers := pool.Capacity()
+			if update.MinWorkers != nil {
+				minWorkers = *update.MinWorkers
+			}
+			if update.MaxWorkers != nil {
+				maxWorkers = *update.MaxWorkers
+			}
+			if minWorkers < 1 || minWorkers > maxWorkers {
+				writeError(w, http.StatusUnprocessableEntity, models.CodeRequestInvalid,
+					"min_workers must be at least 1 and not above max_workers")
+				return
+			}
+			pool.SetCapacity(minWorkers, maxWorkers)
+			slog.Info("capacity changed", "min_workers", minWorkers, "max_workers", maxWorkers)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, models.CodeMethodNotAllowed, "method not allowed")
+			return
+		}
+		minWorkers, maxWorkers := pool.Capacity()
+		writeJSON(w, http.StatusOK, models.Capacity{
+			MinWorkers:  minWorkers,
+			MaxWorkers:  maxWorkers,
+			Workers:     pool.Size(),
+			BusyWorkers: int(busyWorkers.Value()),
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Error("encode response error", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, models.ErrorResponse{Code: code, Message: message})
+}
@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"calc-website/pkg/metrics"
+	"net/http"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	workers = registry.NewGauge("calc_agent_workers",
+		"Worker goroutines started by the agent.")
+	busyWorkers = registry.NewGauge("calc_agent_busy_workers",
+		"Workers currently processing a task.")
+	_ = registry.NewGaugeFunc("calc_agent_worker_utilization",
+		"Share of workers currently processing a task.", func() float64 {
+			total := workers.Value()
+			if total == 0 {
+				return 0
+			}
+			return busyWorkers.Value() / total
+		})
+	queueDepth = registry.NewGauge("calc_agent_orchestrator_queue_depth",
+		"Tasks waiting for an agent as last reported by the orchestrator.")
+	breakerOpen = registry.NewGauge("calc_agent_circuit_breaker_open",
+		"1 while the agent stops polling an unavailable orchestrator.")
+	outboxResults = registry.NewGauge("calc_agent_outbox_results",
+		"Computed results waiting for the orchestrator to become reachable.")
+	resultsDropped = registry.NewCounterVec("calc_agent_results_dropped_total",
+		"Computed results dropped because the outbox was full.")
+	busySeconds = registry.NewCounterVec("calc_agent_busy_seconds_total",
+		"Total time workers spent processing tasks.")
+	tasksProcessed = registry.NewCounterVec("calc_agent_tasks_total",
+		"Tasks computed and accepted by the orchestrator.", "operation")
+	tasksFailed = registry.NewCounterVec("calc_agent_tasks_failed_total",
+		"Tasks that could not be computed or whose results were rejected or dropped.", "operation")
+	computeDuration = registry.NewHistogramVec("calc_agent_compute_seconds",
+		"Time spent computing a task, including its operation time.", metrics.DefBuckets, "operation")
+)
+
+// MetricsHandler serves the agent metrics in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return registry
+}
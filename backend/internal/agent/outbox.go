@@ -0,0 +1,308 @@
+package agent
+
+import (
+	"bytes"
+	"calc-website/internal/models"
+	"calc-website/pkg/tracing"
+	"calc-website/pkg/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrResultRejected is returned when the orchestrator refuses a result, e.g.
+// because the task no longer exists. Such results are not retried.
+var ErrResultRejected = errors.New("result rejected")
+
+// pendingResult is a computed result waiting to be accepted by the
+// orchestrator.
+type pendingResult struct {
+	result      models.TaskResult
+	operation   string
+	traceParent string
+}
+
+// failed reports whether the result is a failure report. Its task was
+// already counted as failed when the computation failed.
+func (pending pendingResult) failed() bool {
+	return pending.result.Error != ""
+}
+
+// postResult sends a result once. It succeeds only when the orchestrator
+// confirms that it accepted the result.
+func postResult(taskUrl string, pending pendingResult) error {
+	body, err := json.Marshal(pending.result)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, taskUrl, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if pending.traceParent != "" {
+		req.Header.Set(tracing.Header, pending.traceParent)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: post result of task %s: %w", ErrUnavailable, pending.result.TaskID, err)
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("%w: post result of task %s: %s", ErrUnavailable, pending.result.TaskID, resp.Status)
+	default:
+		return fmt.Errorf("%w: task %s: %s", ErrResultRejected, pending.result.TaskID, resp.Status)
+	}
+}
+
+// postResults sends a batch of results once and returns the IDs of the
+// tasks the orchestrator rejected.
+func postResults(taskUrl string, batch []pendingResult) ([]models.ID, error) {
+	results := make([]models.TaskResult, len(batch))
+	for i, pending := range batch {
+		results[i] = pending.result
+		results[i].TraceParent = pending.traceParent
+	}
+	body, err := json.Marshal(results)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(taskUrl, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: post %d results: %w", ErrUnavailable, len(batch), err)
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return nil, fmt.Errorf("%w: post %d results: %s", ErrUnavailable, len(batch), resp.Status)
+	default:
+		return nil, fmt.Errorf("%w: batch of %d results: %s", ErrResultRejected, len(batch), resp.Status)
+	}
+	var response models.ResultBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("%w: read accepted results: %w", ErrUnavailable, err)
+	}
+	return response.Rejected, nil
+}
+
+// outbox delivers results to the orchestrator. With a batch size above 1,
+// results finished while a batch is being posted are sent together in the
+// next one. Results that cannot be delivered after a few attempts are kept,
+// oldest first, and delivered once the orchestrator is reachable again.
+// When the outbox is full the oldest result is dropped; the orchestrator
+// queues its task again once the lease expires.
+type outbox struct {
+	taskUrl   string
+	attempts  int
+	retryMin  time.Duration
+	retryMax  time.Duration
+	size      int
+	batchSize int
+
+	mu sync.Mutex
+	// pending are the kept results waiting for the orchestrator
+	pending []pendingResult
+	// queued are the results waiting for the batch being posted
+	queued  []pendingResult
+	sending bool
+}
+
+// Send posts a result, retrying transient failures. A result that still is
+// not accepted is kept for Flush and an ErrUnavailable error is returned.
+// While another batch is being posted, the result is queued for the next
+// batch and Send returns at once.
+func (o *outbox) Send(ctx context.Context, pending pendingResult) error {
+	if o.batchSize <= 1 {
+		return o.deliver(ctx, []pendingResult{pending})
+	}
+	o.mu.Lock()
+	o.queued = append(o.queued, pending)
+	if o.sending {
+		o.mu.Unlock()
+		return nil
+	}
+	o.sending = true
+	o.mu.Unlock()
+
+	var err error
+	for {
+		o.mu.Lock()
+		n := min(len(o.queued), o.batchSize)
+		if n == 0 {
+			o.sending = false
+			o.mu.Unlock()
+			return err
+		}
+		batch := o.queued[:n:n]
+		o.queued = o.queued[n:]
+		o.mu.Unlock()
+		if deliverErr := o.deliver(ctx, batch); deliverErr != nil {
+			err = deliverErr
+		}
+	}
+}
+
+// deliver posts a batch, retrying transient failures, and keeps the results
+// that still are not accepted.
+func (o *outbox) deliver(ctx context.Context, batch []pendingResult) error {
+	retry := backoff{min: o.retryMin, max: o.retryMax}
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = o.post(batch)
+		if !errors.Is(err, ErrUnavailable) || attempt >= o.attempts || ctx.Err() != nil {
+			break
+		}
+		sleep(ctx, retry.Next())
+	}
+	if errors.Is(err, ErrUnavailable) {
+		for _, pending := range batch {
+			o.keep(pending)
+		}
+	}
+	return err
+}
+
+// Flush posts the kept results, oldest first, until a batch fails to be
+// delivered. It returns the number of results still kept.
+func (o *outbox) Flush() int {
+	for {
+		o.mu.Lock()
+		batch := o.pending[:min(len(o.pending), max(o.batchSize, 1))]
+		batch = append([]pendingResult(nil), batch...)
+		o.mu.Unlock()
+		if len(batch) == 0 {
+			return 0
+		}
+
+		err := o.post(batch)
+		if errors.Is(err, ErrUnavailable) {
+			return o.Len()
+		}
+		o.remove(batch)
+	}
+}
+
+// Run flushes the kept results until ctx is done, backing off while the
+// orchestrator stays unavailable.
+func (o *outbox) Run(ctx context.Context) {
+	retry := backoff{min: o.retryMin, max: o.retryMax}
+	for ctx.Err() == nil {
+		sleep(ctx, retry.Next())
+		if o.Len() == 0 || o.Flush() == 0 {
+			retry.Reset()
+		}
+	}
+}
+
+// Len returns the number of kept results.
+func (o *outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// post sends a batch once and accounts for its outcome. A single result
+// goes to the single-result endpoint unless batches are enabled.
+func (o *outbox) post(batch []pendingResult) error {
+	if o.batchSize <= 1 && len(batch) == 1 {
+		pending := batch[0]
+		err := postResult(o.taskUrl, pending)
+		switch {
+		case err == nil:
+			o.accepted(pending)
+		case errors.Is(err, ErrResultRejected):
+			o.rejected(pending, err)
+		}
+		return err
+	}
+
+	rejectedIDs, err := postResults(o.taskUrl, batch)
+	if errors.Is(err, ErrUnavailable) {
+		return err
+	}
+	rejected := make(map[models.ID]bool, len(rejectedIDs))
+	for _, id := range rejectedIDs {
+		rejected[id] = true
+	}
+	for _, pending := range batch {
+		switch {
+		case err != nil:
+			o.rejected(pending, err)
+		case rejected[pending.result.TaskID]:
+			o.rejected(pending, ErrResultRejected)
+		default:
+			o.accepted(pending)
+		}
+	}
+	if err == nil && len(rejectedIDs) > 0 {
+		err = fmt.Errorf("%w: tasks %v", ErrResultRejected, rejectedIDs)
+	}
+	return err
+}
+
+func (o *outbox) accepted(pending pendingResult) {
+	if !pending.failed() {
+		tasksProcessed.Inc(pending.operation)
+	}
+	slog.Debug("task result accepted", "task_id", pending.result.TaskID, "result", pending.result.Result)
+}
+
+func (o *outbox) rejected(pending pendingResult, err error) {
+	if !pending.failed() {
+		tasksFailed.Inc(pending.operation)
+	}
+	slog.Error("task result rejected", "task_id", pending.result.TaskID, "error", err)
+}
+
+// remove forgets delivered results. Results dropped in the meantime are
+// simply not found.
+func (o *outbox) remove(batch []pendingResult) {
+	delivered := make(map[models.ID]bool, len(batch))
+	for _, pending := range batch {
+		delivered[pending.result.TaskID] = true
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	kept := o.pending[:0]
+	for _, pending := range o.pending {
+		if !delivered[pending.result.TaskID] {
+			kept = append(kept, pending)
+		}
+	}
+	o.pending = kept
+	outboxResults.Set(float64(len(o.pending)))
+}
+
+func (o *outbox) keep(pending pendingResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.size == 0 {
+		if !pending.failed() {
+			tasksFailed.Inc(pending.operation)
+		}
+		resultsDropped.Inc()
+		slog.Error("task result dropped", "task_id", pending.result.TaskID)
+		return
+	}
+	if len(o.pending) >= o.size {
+		dropped := o.pending[0]
+		o.pending = o.pending[1:]
+		if !dropped.failed() {
+			tasksFailed.Inc(dropped.operation)
+		}
+		resultsDropped.Inc()
+		slog.Error("outbox full, task result dropped", "task_id", dropped.result.TaskID)
+	}
+	o.pending = append(o.pending, pending)
+	outboxResults.Set(float64(len(o.pending)))
+	slog.Warn("task result kept for later delivery", "task_id", pending.result.TaskID, "outbox", len(o.pending))
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"calc-website/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resultServer answers result posts with the next status of statuses, then
+// with 200, and records the accepted results.
+type resultServer struct {
+	mu       sync.Mutex
+	statuses []int
+	posts    int
+	accepted []models.ID
+}
+
+func (s *resultServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.posts++
+	if len(s.statuses) > 0 {
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	var result models.TaskResult
+	_ = json.NewDecoder(r.Body).Decode(&result)
+	s.accepted = append(s.accepted, result.TaskID)
+}
+
+func newTestOutbox(url string, attempts, size int) *outbox {
+	return &outbox{taskUrl: url, attempts: attempts, retryMin: time.Millisecond, retryMax: time.Millisecond, size: size}
+}
+
+func testResult() pendingResult {
+	return pendingResult{result: models.TaskResult{TaskID: models.NewID(), Result: 1}, operation: "+"}
+}
+
+func TestOutboxRetries(t *testing.T) {
+	handler := &resultServer{statuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	results := newTestOutbox(server.URL, 3, 10)
+	if err := results.Send(context.Background(), testResult()); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if handler.posts != 3 || len(handler.accepted) != 1 || results.Len() != 0 {
+		t.Errorf("%d posts, %d accepted, %d kept; expected the third attempt to succeed",
+			handler.posts, len(handler.accepted), results.Len())
+	}
+
+	handler.statuses = []int{http.StatusNotFound}
+	if err := results.Send(context.Background(), testResult()); !errors.Is(err, ErrResultRejected) {
+		t.Errorf("Send() of an unknown task = %v, expected ErrResultRejected", err)
+	}
+	if handler.posts != 4 || results.Len() != 0 {
+		t.Errorf("rejected result was retried or kept: %d posts, %d kept", handler.posts, results.Len())
+	}
+}
+
+func TestOutboxKeepsResultsDuringOutage(t *testing.T) {
+	handler := &resultServer{}
+	server := httptest.NewServer(handler)
+	url := server.URL
+	server.Close()
+
+	results := newTestOutbox(url, 2, 2)
+	sent := []pendingResult{testResult(), testResult(), testResult()}
+	for _, pending := range sent {
+		if err := results.Send(context.Background(), pending); !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("Send() during an outage = %v, expected ErrUnavailable", err)
+		}
+	}
+	if kept := results.Flush(); kept != 2 {
+		t.Fatalf("Flush() during an outage = %d, expected the 2 newest results kept", kept)
+	}
+
+	server = httptest.NewServer(handler)
+	defer server.Close()
+	results.taskUrl = server.URL
+	if kept := results.Flush(); kept != 0 {
+		t.Fatalf("Flush() = %d after the outage, expected every result delivered", kept)
+	}
+	// the oldest result was dropped when the outbox was full
+	if len(handler.accepted) != 2 || handler.accepted[0] != sent[1].result.TaskID || handler.accepted[1] != sent[2].result.TaskID {
+		t.Errorf("delivered %v, expected %s and %s in order", handler.accepted, sent[1].result.TaskID, sent[2].result.TaskID)
+	}
+}
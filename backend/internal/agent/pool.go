@@ -0,0 +1,316 @@
+package agent
+
+import (
+	"calc-website/config"
+	"calc-website/internal/models"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pool runs agent workers and changes their number at runtime, between the
+// bounds of its capacity. A worker removed from the pool finishes its
+// current task before it stops.
+type Pool struct {
+	ctx      context.Context
+	abandon  context.Context
+	hostname string
+	results  *outbox
+	// batchSize above 1 makes a single fetcher poll for batches of tasks
+	// and hand them to the workers through tasks
+	batchSize int
+	tasks     chan *models.TaskResponse
+	// handling counts the tasks handed to workers by FetchBatches whose
+	// results are not sent yet
+	handling atomic.Int64
+	pollMin  time.Duration
+	pollMax  time.Duration
+	breaker  *breaker
+
+	mu         sync.Mutex
+	minWorkers int
+	maxWorkers int
+	// stops cancels the running workers, the most recently started last
+	stops []context.CancelFunc
+	// started numbers the workers so agent IDs are never reused
+	started int
+	wg      sync.WaitGroup
+}
+
+// NewPool returns an empty pool with the capacity of cfg.WorkerLimits whose
+// workers stop when ctx is done. Tasks still computing
+// cfg.ShutdownTimeoutMs later are returned to the orchestrator.
+func NewPool(ctx context.Context, cfg *config.Config) *Pool {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "agent"
+	}
+	abandon, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	context.AfterFunc(ctx, func() {
+		time.AfterFunc(time.Duration(cfg.ShutdownTimeoutMs)*time.Millisecond, cancel)
+	})
+	minWorkers, maxWorkers := cfg.WorkerLimits()
+	return &Pool{
+		ctx:      ctx,
+		abandon:  abandon,
+		hostname: hostname,
+		results: &outbox{
+			taskUrl:   cfg.OrchestratorUrl + "/internal/task",
+			attempts:  cfg.AgentResultAttempts,
+			retryMin:  time.Duration(cfg.AgentPollMinMs) * time.Millisecond,
+			retryMax:  time.Duration(cfg.AgentPollMaxMs) * time.Millisecond,
+			size:      cfg.AgentOutboxSize,
+			batchSize: cfg.AgentBatchSize,
+		},
+		batchSize: cfg.AgentBatchSize,
+		tasks:     make(chan *models.TaskResponse),
+		pollMin:   time.Duration(cfg.AgentPollMinMs) * time.Millisecond,
+		pollMax:   time.Duration(cfg.AgentPollMaxMs) * time.Millisecond,
+		breaker: &breaker{
+			threshold: cfg.AgentBreakerThreshold,
+			cooldown:  time.Duration(cfg.AgentBreakerCooldownMs) * time.Millisecond,
+		},
+		minWorkers: minWorkers,
+		maxWorkers: maxWorkers,
+	}
+}
+
+// Resize starts or stops workers until n are running, keeping n within the
+// capacity of the pool.
+func (p *Pool) Resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resize(n)
+}
+
+// SetCapacity changes the bounds of the pool and moves its size into them.
+func (p *Pool) SetCapacity(minWorkers, maxWorkers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.minWorkers, p.maxWorkers = minWorkers, maxWorkers
+	p.resize(len(p.stops))
+}
+
+// Capacity returns the bounds of the pool.
+func (p *Pool) Capacity() (minWorkers, maxWorkers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.minWorkers, p.maxWorkers
+}
+
+func (p *Pool) resize(n int) {
+	n = max(p.minWorkers, min(n, p.maxWorkers))
+	for len(p.stops) < n {
+		agentID := p.hostname + "/" + strconv.Itoa(p.started)
+		p.started++
+		workerCtx, stop := context.WithCancel(p.ctx)
+		p.stops = append(p.stops, stop)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.work(workerCtx, agentID)
+		}()
+	}
+	for len(p.stops) > n {
+		last := len(p.stops) - 1
+		p.stops[last]()
+		p.stops = p.stops[:last]
+	}
+	workers.Set(float64(n))
+}
+
+// Size returns the number of running workers.
+func (p *Pool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.stops)
+}
+
+// Wait blocks until every worker has stopped.
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
+
+// DeliverResults delivers the results kept while the orchestrator was
+// unavailable until ctx is done.
+func (p *Pool) DeliverResults(ctx context.Context) {
+	p.results.Run(ctx)
+}
+
+// FlushResults makes a last attempt to deliver the kept results and returns
+// the number that could not be delivered.
+func (p *Pool) FlushResults() int {
+	return p.results.Flush()
+}
+
+// Autoscale resizes the pool every interval until ctx is done, from the
+// queue depth last reported by the orchestrator and the busy workers.
+func (p *Pool) Autoscale(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		queued, busy := int(queueDepth.Value()), int(busyWorkers.Value())
+		p.mu.Lock()
+		size := len(p.stops)
+		desired := desiredWorkers(size, busy, queued, p.minWorkers, p.maxWorkers)
+		if desired != size {
+			slog.Info("scaling workers", "from", size, "to", desired, "queued", queued, "busy", busy)
+			p.resize(desired)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// desiredWorkers grows the pool while tasks wait and at least three
+// quarters of the workers are busy, by up to its current size at once. It
+// shrinks the pool by one worker at a time while the queue is empty and
+// most workers sit idle.
+func desiredWorkers(size, busy, queued, minWorkers, maxWorkers int) int {
+	desired := size
+	switch {
+	case queued > 0 && busy*4 >= size*3:
+		desired = size + min(queued, max(size, 1))
+	case queued == 0 && busy*2 < size:
+		desired = size - 1
+	}
+	return max(minWorkers, min(desired, maxWorkers))
+}
+
+// FetchBatches starts polling for batches of tasks and handing each task to
+// an idle worker until ctx is done; Wait also waits for the fetcher. A batch
+// asks for no more tasks than there are idle workers, so tasks do not wait
+// leased to this agent; a worker is busy until the result of its task is
+// sent. Each poll reports the pool size, so the orchestrator counts every
+// worker behind the single fetcher. Tasks not handed out when ctx is done
+// are returned to the orchestrator; a poll cut short by ctx leaves its batch
+// to the orchestrator's lease timeout.
+func (p *Pool) FetchBatches(ctx context.Context) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.fetchBatches(ctx)
+	}()
+}
+
+func (p *Pool) fetchBatches(ctx context.Context) {
+	agentID := p.hostname + "/fetch"
+	poll := backoff{min: p.pollMin, max: p.pollMax}
+	for ctx.Err() == nil {
+		if wait := p.breaker.Allow(); wait > 0 {
+			sleep(ctx, wait)
+			continue
+		}
+		size := p.Size()
+		idle := size - int(p.handling.Load())
+		tasks, err := fetchTasks(ctx, p.results.taskUrl, agentID, size, max(1, min(idle, p.batchSize)))
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, ErrNoTasks):
+			p.breaker.Success()
+			sleep(ctx, poll.Next())
+			continue
+		case errors.Is(err, ErrUnavailable):
+			p.breaker.Failure()
+			slog.Warn("orchestrator request error", "agent_id", agentID, "error", err)
+			sleep(ctx, poll.Next())
+			continue
+		case err != nil:
+			slog.Error("fetch tasks error", "agent_id", agentID, "error", err)
+			sleep(ctx, poll.Next())
+			continue
+		}
+		p.breaker.Success()
+		poll.Reset()
+		for i, task := range tasks {
+			p.handling.Add(1)
+			select {
+			case p.tasks <- task:
+			case <-ctx.Done():
+				p.handling.Add(-1)
+				for _, unstarted := range tasks[i:] {
+					if err := returnTask(p.results.taskUrl, unstarted.ID, agentID); err != nil {
+						slog.Error("return task error", "task_id", unstarted.ID, "error", err)
+					}
+				}
+				return
+			}
+		}
+	}
+}
+
+// workBatches computes the tasks handed out by FetchBatches until ctx is done.
+func (p *Pool) workBatches(ctx context.Context, agentID string) {
+	for {
+		var task *models.TaskResponse
+		select {
+		case <-ctx.Done():
+			return
+		case task = <-p.tasks:
+		}
+		pending, err := computeTask(p.abandon, p.results.taskUrl, task, agentID)
+		if pending != nil {
+			if sendErr := p.results.Send(p.abandon, *pending); sendErr != nil {
+				err = sendErr
+			}
+			if errors.Is(err, ErrUnavailable) {
+				p.breaker.Failure()
+			}
+		}
+		p.handling.Add(-1)
+		if err != nil {
+			slog.Error("process task error", "agent_id", agentID, "error", err)
+		}
+	}
+}
+
+// work polls for tasks until ctx is done. It polls again right away after
+// a task and backs off while the queue is empty or the orchestrator fails.
+func (p *Pool) work(ctx context.Context, agentID string) {
+	if p.batchSize > 1 {
+		p.workBatches(ctx, agentID)
+		return
+	}
+	poll := backoff{min: p.pollMin, max: p.pollMax}
+	for ctx.Err() == nil {
+		if wait := p.breaker.Allow(); wait > 0 {
+			sleep(ctx, wait)
+			continue
+		}
+		err := processTask(p.abandon, p.results, agentID)
+		switch {
+		case errors.Is(err, ErrNoTasks):
+			p.breaker.Success()
+			sleep(ctx, poll.Next())
+		case errors.Is(err, ErrUnavailable):
+			p.breaker.Failure()
+			slog.Warn("orchestrator request error", "agent_id", agentID, "error", err)
+			sleep(ctx, poll.Next())
+		default:
+			p.breaker.Success()
+			poll.Reset()
+			if err != nil {
+				slog.Error("process task error", "agent_id", agentID, "error", err)
+			}
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
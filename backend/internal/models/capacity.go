@@ -0,0 +1,15 @@
+package models
+
+// Capacity describes the worker pool of an agent.
+type Capacity struct {
+	MinWorkers  int `json:"min_workers"`
+	MaxWorkers  int `json:"max_workers"`
+	Workers     int `json:"workers"`
+	BusyWorkers int `json:"busy_workers"`
+}
+
+// CapacityUpdate changes the bounds that are set and keeps the others.
+type CapacityUpdate struct {
+	MinWorkers *int `json:"min_workers,omitempty"`
+	MaxWorkers *int `json:"max_workers,omitempty"`
+}
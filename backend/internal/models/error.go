@@ -0,0 +1,27 @@
+package models
+
+// Error codes are part of the API and must not change.
+const (
+	CodeExpressionInvalid     = "EXPRESSION_INVALID"
+	CodeDivisionByZero        = "DIVISION_BY_ZERO"
+	CodeUnknownOperator       = "UNKNOWN_OPERATOR"
+	CodeRequestInvalid        = "REQUEST_INVALID"
+	CodeIDInvalid             = "ID_INVALID"
+	CodeCallbackURLInvalid    = "CALLBACK_URL_INVALID"
+	CodeCallbacksDisabled     = "CALLBACKS_DISABLED"
+	CodePriorityInvalid       = "PRIORITY_INVALID"
+	CodeNotFound              = "NOT_FOUND"
+	CodeExpressionNotFinished = "EXPRESSION_NOT_FINISHED"
+	CodeMethodNotAllowed      = "METHOD_NOT_ALLOWED"
+	CodeBacklogFull           = "BACKLOG_FULL"
+	CodeShuttingDown          = "SHUTTING_DOWN"
+	CodeUnauthorized          = "UNAUTHORIZED"
+	CodeTimingInvalid         = "TIMING_INVALID"
+	CodeInternal              = "INTERNAL"
+)
+
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
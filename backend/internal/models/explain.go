@@ -0,0 +1,36 @@
+package models
+
+import "calc-website/pkg/calc"
+
+type ExplainRequest struct {
+	Expression string `json:"expression"`
+	Optimize   bool   `json:"optimize,omitempty"`
+	// Agents overrides the number of agents used for the estimate
+	Agents int `json:"agents,omitempty"`
+}
+
+// PlanArgument is either a number or a reference to the task computing it.
+type PlanArgument struct {
+	Value  *float64 `json:"value,omitempty"`
+	TaskID string   `json:"task,omitempty"`
+}
+
+type PlanTask struct {
+	ID            string       `json:"id"`
+	Operation     string       `json:"operation"`
+	Arg1          PlanArgument `json:"arg1"`
+	Arg2          PlanArgument `json:"arg2"`
+	OperationTime int          `json:"operation_time"`
+	CriticalPath  int          `json:"critical_path"`
+	Level         int          `json:"level"`
+}
+
+type ExplainResponse struct {
+	AST         *calc.Node `json:"ast"`
+	Infix       string     `json:"infix"`
+	Tasks       []PlanTask `json:"tasks"`
+	Depth       int        `json:"depth"`
+	Width       int        `json:"width"`
+	Agents      int        `json:"agents"`
+	EstimatedMs int        `json:"estimated_ms"`
+}
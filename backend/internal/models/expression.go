@@ -1,15 +1,63 @@
 package models
 
+import "time"
+
+const (
+	StatusPending   = "pending"
+	StatusConfirmed = "confirmed"
+	StatusFailed    = "failed"
+)
+
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+var priorityLevels = map[string]int{
+	PriorityLow:    0,
+	PriorityNormal: 1,
+	PriorityHigh:   2,
+}
+
+// PriorityLevel converts a priority name into a level, higher runs first.
+func PriorityLevel(priority string) (int, bool) {
+	level, exists := priorityLevels[priority]
+	return level, exists
+}
+
 type ExpressionRequest struct {
-	Expression string `json:"expression"`
+	Expression  string `json:"expression"`
+	CallbackURL string `json:"callback_url,omitempty"`
+	Optimize    bool   `json:"optimize,omitempty"`
+	User        string `json:"user,omitempty"`
+	Priority    string `json:"priority,omitempty"`
+	// TraceParent is the trace context of the submitting request
+	TraceParent string `json:"-"`
+}
+
+type PriorityRequest struct {
+	Priority string `json:"priority"`
 }
 
 type ExpressionResponse struct {
-	ExpressionID string `json:"id"`
+	ExpressionID ID `json:"id"`
 }
 
 type Expression struct {
-	ID     uint32  `json:"id"`
-	Status string  `json:"status"`
-	Result float64 `json:"result"`
+	ID          ID         `json:"id"`
+	User        string     `json:"user,omitempty"`
+	Status      string     `json:"status"`
+	Priority    string     `json:"priority"`
+	Result      float64    `json:"result"`
+	Error       string     `json:"error,omitempty"`
+	CallbackURL string     `json:"callback_url,omitempty"`
+	Optimized   string     `json:"optimized,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	TraceID     string     `json:"trace_id,omitempty"`
+}
+
+func (expression *Expression) IsFinished() bool {
+	return expression.Status == StatusConfirmed || expression.Status == StatusFailed
 }
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+var ErrIDInvalid = errors.New("id is invalid")
+
+// ID identifies expressions and tasks. New IDs are UUIDv7, so they are unique
+// across instances and sort by creation time.
+type ID string
+
+func NewID() ID {
+	return ID(uuid.Must(uuid.NewV7()).String())
+}
+
+// LegacyID maps a numeric ID issued by older versions onto the UUID space.
+// Such IDs have version 0 and never clash with UUIDv7.
+func LegacyID(id uint32) ID {
+	var legacy uuid.UUID
+	binary.BigEndian.PutUint32(legacy[12:], id)
+	return ID(legacy.String())
+}
+
+// ParseID accepts a UUID in any form understood by uuid.Parse or a legacy
+// numeric ID and returns it in canonical form.
+func ParseID(value string) (ID, error) {
+	if legacy, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return LegacyID(uint32(legacy)), nil
+	}
+	parsed, err := uuid.Parse(value)
+	if err != nil {
+		return "", ErrIDInvalid
+	}
+	return ID(parsed.String()), nil
+}
+
+// UnmarshalJSON accepts both strings and the bare numbers used by older clients.
+func (id *ID) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		err := json.Unmarshal(data, &value)
+		if err != nil {
+			return err
+		}
+	}
+	parsed, err := ParseID(value)
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseID(t *testing.T) {
+	id := NewID()
+	tests := []struct {
+		value    string
+		expected ID
+		valid    bool
+	}{
+		{string(id), id, true},
+		{"urn:uuid:" + string(id), id, true},
+		{"3991160650", "00000000-0000-0000-0000-0000ede4474a", true},
+		{"not-an-id", "", false},
+		{"99999999999", "", false},
+	}
+
+	for _, tc := range tests {
+		parsed, err := ParseID(tc.value)
+		if (err == nil) != tc.valid || parsed != tc.expected {
+			t.Errorf("ParseID(%q) = %q, %v, expected %q, valid %v", tc.value, parsed, err, tc.expected, tc.valid)
+		}
+	}
+}
+
+func TestIDOrdering(t *testing.T) {
+	first, second := NewID(), NewID()
+	if first >= second {
+		t.Errorf("NewID() is not time ordered: %q >= %q", first, second)
+	}
+}
+
+func TestUnmarshalLegacyTaskResult(t *testing.T) {
+	var result TaskResult
+	err := json.Unmarshal([]byte(`{"id": 3991160650, "result": 6}`), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TaskID != LegacyID(3991160650) {
+		t.Errorf("TaskID = %q, expected %q", result.TaskID, LegacyID(3991160650))
+	}
+}
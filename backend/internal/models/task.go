@@ -1,34 +1,113 @@
 package models
 
+import (
+	"slices"
+	"time"
+)
+
+// AgentIDHeader identifies the agent worker polling for tasks.
+const AgentIDHeader = "X-Agent-ID"
+
+// AgentWorkersHeader carries the number of workers a batch poll fetches
+// for. A poll without it counts as a single worker.
+const AgentWorkersHeader = "X-Agent-Workers"
+
+// QueueDepthHeader carries the number of tasks waiting for an agent in the
+// responses to task polls, so agents can size their worker pools.
+const QueueDepthHeader = "X-Queue-Depth"
+
 type TaskResult struct {
-	TaskID string  `json:"id"`
+	TaskID ID      `json:"id"`
 	Result float64 `json:"result"`
+	// Error is the code of a failed computation, such as DIVISION_BY_ZERO;
+	// the result is ignored when it is set
+	Error string `json:"error,omitempty"`
+	// TraceParent is the context of the compute span in batches of results;
+	// a single result carries it in a header
+	TraceParent string `json:"traceparent,omitempty"`
+	// AgentID is the worker that computed the task, which may differ from
+	// the one that leased it
+	AgentID string `json:"agent_id,omitempty"`
+}
+
+// ResultBatchResponse tells an agent which results of a batch were accepted.
+// Rejected results belong to unknown tasks and must not be sent again.
+type ResultBatchResponse struct {
+	Accepted []ID `json:"accepted"`
+	Rejected []ID `json:"rejected"`
+}
+
+// TaskBatch is the response to a poll for several tasks.
+type TaskBatch struct {
+	Tasks []*TaskResponse `json:"tasks"`
 }
 
 type Argument struct {
 	Value        float64
 	Ready        bool
-	ParentTaskID uint32
+	ParentTaskID ID
 }
 
 type Task struct {
-	ID            uint32
-	ExpressionID  uint32
-	ParentArgID   uint32
-	Arg1          *Argument
-	Arg2          *Argument
+	ID ID
+	// ExpressionID is the expression that created the task; shared
+	// subexpressions may also feed other expressions
+	ExpressionID ID
+	// SharedWith lists the other expressions that reuse the task while it
+	// is pending; they trace it as well
+	SharedWith    []ID
+	User          string
+	Hash          string
+	ExpressionIDs []ID
+	ParentArgIDs  []ID
+	Arg1ID        ID
+	Arg2ID        ID
+	Arg1          *Argument `json:"-"`
+	Arg2          *Argument `json:"-"`
 	Operation     string
 	OperationTime int
+	// CriticalPath is the total operation time from this task to the root
+	CriticalPath int
+	Leased       bool
+	AgentID      string
+	Confirmed    bool
+	Result       float64
+	// Error is the code of a failed computation; the task is confirmed
+	// without a result
+	Error    string
+	CacheHit bool
+	// EnqueuedAt is the time both arguments became known
+	EnqueuedAt  time.Time
+	LeasedAt    *time.Time
+	CompletedAt time.Time
 }
 
 type TaskResponse struct {
-	ID            string  `json:"id"`
+	ID            ID      `json:"id"`
 	Arg1          float64 `json:"arg1"`
 	Arg2          float64 `json:"arg2"`
 	Operation     string  `json:"operation"`
 	OperationTime int     `json:"operation_time"`
+	// TraceParent is the context of the task span. A single task also
+	// carries it in a header.
+	TraceParent string `json:"traceparent,omitempty"`
 }
 
 func (task *Task) IsReady() bool {
 	return task.Arg1.Ready && task.Arg2.Ready
 }
+
+// TracedBy reports whether the task belongs to the trace of expressionID.
+func (task *Task) TracedBy(expressionID ID) bool {
+	return task.ExpressionID == expressionID || slices.Contains(task.SharedWith, expressionID)
+}
+
+// AddDependent registers a consumer of the task result: the argument of a
+// parent task or, for a root task (empty parentArgID), the expression itself.
+func (task *Task) AddDependent(parentArgID ID, expressionID ID) {
+	if parentArgID != "" {
+		task.ParentArgIDs = append(task.ParentArgIDs, parentArgID)
+	} else {
+		task.ExpressionIDs = append(task.ExpressionIDs, expressionID)
+	}
+}
@@ -0,0 +1,54 @@
+package models
+
+// OperationTimings are the times agents spend on each operation, in ms.
+type OperationTimings struct {
+	AdditionMs       int `json:"addition_ms"`
+	SubtractionMs    int `json:"subtraction_ms"`
+	MultiplicationMs int `json:"multiplication_ms"`
+	DivisionMs       int `json:"division_ms"`
+}
+
+// For returns the time of an operator, or 0 for an unknown one.
+func (t OperationTimings) For(operator string) int {
+	switch operator {
+	case "+":
+		return t.AdditionMs
+	case "-":
+		return t.SubtractionMs
+	case "*":
+		return t.MultiplicationMs
+	case "/":
+		return t.DivisionMs
+	default:
+		return 0
+	}
+}
+
+// TimingsUpdate changes the timings that are set and keeps the others.
+type TimingsUpdate struct {
+	AdditionMs       *int `json:"addition_ms,omitempty"`
+	SubtractionMs    *int `json:"subtraction_ms,omitempty"`
+	MultiplicationMs *int `json:"multiplication_ms,omitempty"`
+	DivisionMs       *int `json:"division_ms,omitempty"`
+}
+
+func (u TimingsUpdate) Apply(t OperationTimings) OperationTimings {
+	for _, field := range []struct {
+		value  *int
+		target *int
+	}{
+		{u.AdditionMs, &t.AdditionMs},
+		{u.SubtractionMs, &t.SubtractionMs},
+		{u.MultiplicationMs, &t.MultiplicationMs},
+		{u.DivisionMs, &t.DivisionMs},
+	} {
+		if field.value != nil {
+			*field.target = *field.value
+		}
+	}
+	return t
+}
+
+func (t OperationTimings) IsValid() bool {
+	return t.AdditionMs >= 0 && t.SubtractionMs >= 0 && t.MultiplicationMs >= 0 && t.DivisionMs >= 0
+}
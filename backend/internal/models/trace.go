@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// TaskTrace describes how a single task of an expression was executed.
+// Tasks resolved from the result cache have no lease and no agent.
+type TaskTrace struct {
+	ID          ID         `json:"id"`
+	Operation   string     `json:"operation"`
+	Arg1        float64    `json:"arg1"`
+	Arg2        float64    `json:"arg2"`
+	Result      float64    `json:"result"`
+	Error       string     `json:"error,omitempty"`
+	AgentID     string     `json:"agent_id,omitempty"`
+	CacheHit    bool       `json:"cache_hit"`
+	EnqueuedAt  time.Time  `json:"enqueued_at"`
+	LeasedAt    *time.Time `json:"leased_at,omitempty"`
+	CompletedAt time.Time  `json:"completed_at"`
+	// WaitMs is the time the task spent in the queue before an agent leased it
+	WaitMs int64 `json:"wait_ms"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+type WebhookDelivery struct {
+	Attempt    int       `json:"attempt"`
+	URL        string    `json:"url"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error,omitempty"`
+	Success    bool      `json:"success"`
+	Timestamp  time.Time `json:"timestamp"`
+}
@@ -0,0 +1,36 @@
+package orchestrator
+
+import "time"
+
+// agentActivityWindow is how long an agent counts as active after its last poll.
+const agentActivityWindow = 10 * time.Second
+
+// agentActivity is the last poll of an agent and the number of workers it
+// polled for.
+type agentActivity struct {
+	lastSeen time.Time
+	workers  int
+}
+
+// touchAgent must be called with s.mu held.
+func (s *APIService) touchAgent(agentID string, workers int, now time.Time) {
+	if agentID != "" {
+		s.agents[agentID] = agentActivity{lastSeen: now, workers: max(1, workers)}
+	}
+}
+
+// ActiveAgents returns the number of agent workers that polled recently.
+func (s *APIService) ActiveAgents() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	active := 0
+	for agentID, activity := range s.agents {
+		if now.Sub(activity.lastSeen) > agentActivityWindow {
+			delete(s.agents, agentID)
+			continue
+		}
+		active += activity.workers
+	}
+	return active
+}
@@ -2,30 +2,92 @@ package orchestrator
 
 import (
 	"calc-website/config"
-	"log"
+	"calc-website/pkg/logging"
+	"calc-website/pkg/tracing"
+	"context"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/rs/cors"
 )
 
 func Run(cfg *config.Config) error {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	if err := logging.Setup(os.Stderr, cfg.LogLevel); err != nil {
+		slog.Warn("invalid log level, using info", "level", cfg.LogLevel)
+	}
 	service := NewAPIService(cfg)
+	if cfg.StateFile != "" {
+		if err := service.LoadState(cfg.StateFile); err != nil {
+			return err
+		}
+	}
+	if err := service.LoadTimings(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go config.WatchReload(ctx, cfg, func(updated *config.Config, changes []config.Change) {
+		if err := logging.SetLevel(updated.LogLevel); err != nil {
+			slog.Error("set log level error", "level", updated.LogLevel, "error", err)
+		}
+		if err := service.ApplyConfig(updated, changes); err != nil {
+			slog.Error("apply configuration error", "error", err)
+		}
+	})
+	if cfg.JanitorIntervalMs > 0 {
+		go service.RunJanitor(ctx, time.Duration(cfg.JanitorIntervalMs)*time.Millisecond)
+	}
 	apiHandler := NewAPIHandler(service)
 	router := apiHandler.Router()
 	// Настраиваем CORS
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"}, // Разрешить запросы с любого источника
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders:   []string{"Content-Type"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", tracing.Header, logging.RequestIDHeader},
 		AllowCredentials: true,
 	})
 
 	// Запускаем сервер с CORS
-	handler := c.Handler(router)
-	err := http.ListenAndServe(":8080", handler)
-	if err != nil {
+	server := &http.Server{Addr: cfg.ListenAddr, Handler: c.Handler(router)}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
 		return err
+	case <-ctx.Done():
+	}
+	return shutdown(cfg, service, server)
+}
+
+// shutdown lets agents deliver or return their leased tasks, drains the
+// in-flight HTTP requests and saves the state.
+func shutdown(cfg *config.Config, service *APIService, server *http.Server) error {
+	slog.Info("shutting down")
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(),
+		time.Duration(cfg.TaskDrainTimeoutMs)*time.Millisecond)
+	service.Drain(drainCtx)
+	cancelDrain()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(),
+		time.Duration(cfg.ShutdownTimeoutMs)*time.Millisecond)
+	defer cancelShutdown()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("http shutdown error", "error", err)
+	}
+
+	if cfg.StateFile != "" {
+		if saveErr := service.SaveState(cfg.StateFile); saveErr != nil {
+			return saveErr
+		}
+		slog.Info("state saved", "path", cfg.StateFile)
 	}
-	return nil
+	return err
 }
@@ -0,0 +1,82 @@
+package orchestrator
+
+import (
+	"calc-website/internal/models"
+	"calc-website/pkg/calc"
+	"calc-website/pkg/utils"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+var (
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	ErrRequestInvalid   = errors.New("request body is invalid")
+	ErrNoTasks          = errors.New("tasks not found")
+	ErrInternal         = errors.New("internal server error")
+	ErrUnauthorized     = errors.New("unauthorized")
+)
+
+type errorMapping struct {
+	err    error
+	status int
+	code   string
+}
+
+var errorMappings = []errorMapping{
+	{calc.ErrExpressionInvalid, http.StatusUnprocessableEntity, models.CodeExpressionInvalid},
+	// ToTree reports unbalanced expressions through the stack it parses with
+	{utils.ErrArrayEmpty, http.StatusUnprocessableEntity, models.CodeExpressionInvalid},
+	{calc.ErrDivisionByZero, http.StatusUnprocessableEntity, models.CodeDivisionByZero},
+	{calc.ErrUnknownOperator, http.StatusUnprocessableEntity, models.CodeUnknownOperator},
+	{ErrRequestInvalid, http.StatusUnprocessableEntity, models.CodeRequestInvalid},
+	{models.ErrIDInvalid, http.StatusUnprocessableEntity, models.CodeIDInvalid},
+	{ErrCallbackURLInvalid, http.StatusUnprocessableEntity, models.CodeCallbackURLInvalid},
+	{ErrCallbacksDisabled, http.StatusUnprocessableEntity, models.CodeCallbacksDisabled},
+	{ErrPriorityInvalid, http.StatusUnprocessableEntity, models.CodePriorityInvalid},
+	{ErrIDExpressionNotExists, http.StatusNotFound, models.CodeNotFound},
+	{ErrIDTaskNotExists, http.StatusNotFound, models.CodeNotFound},
+	{ErrNoTasks, http.StatusNotFound, models.CodeNotFound},
+	{ErrExpressionNotFinished, http.StatusConflict, models.CodeExpressionNotFinished},
+	{ErrMethodNotAllowed, http.StatusMethodNotAllowed, models.CodeMethodNotAllowed},
+	{ErrUnauthorized, http.StatusUnauthorized, models.CodeUnauthorized},
+	{ErrTimingInvalid, http.StatusUnprocessableEntity, models.CodeTimingInvalid},
+	{ErrBacklogFull, http.StatusServiceUnavailable, models.CodeBacklogFull},
+	{ErrShuttingDown, http.StatusServiceUnavailable, models.CodeShuttingDown},
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		slog.Error("encode response error", "error", err)
+	}
+}
+
+// writeError sends err as an ErrorResponse with the message in the language
+// requested by r. Errors without a mapping are logged and reported as
+// INTERNAL so Go error text does not leak to clients.
+func writeError(w http.ResponseWriter, r *http.Request, err error, details any) {
+	language := negotiateLanguage(r.Header.Get("Accept-Language"))
+	w.Header().Set("Content-Language", language)
+	for _, mapping := range errorMappings {
+		if errors.Is(err, mapping.err) {
+			if mapping.status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "1")
+			}
+			writeJSON(w, mapping.status, models.ErrorResponse{
+				Code:    mapping.code,
+				Message: localizedMessage(mapping.err, language),
+				Details: details,
+			})
+			return
+		}
+	}
+	slog.ErrorContext(r.Context(), "unexpected error", "error", err, "path", r.URL.Path)
+	writeJSON(w, http.StatusInternalServerError, models.ErrorResponse{
+		Code:    models.CodeInternal,
+		Message: localizedMessage(ErrInternal, language),
+	})
+}
@@ -0,0 +1,150 @@
+package orchestrator
+
+import (
+	"calc-website/internal/models"
+	"calc-website/pkg/calc"
+	"sort"
+	"strconv"
+)
+
+// planBuilder mirrors addTasks without touching the service state:
+// identical subtrees become one task, exactly as they would be scheduled.
+type planBuilder struct {
+	timings models.OperationTimings
+	hashes  map[*calc.Node]string
+	indexes map[string]int
+	tasks   []models.PlanTask
+	parents [][]int
+}
+
+func (b *planBuilder) add(node *calc.Node) (models.PlanArgument, int) {
+	if node.Left == nil && node.Right == nil {
+		value, _ := strconv.ParseFloat(node.Value, 64)
+		return models.PlanArgument{Value: &value}, -1
+	}
+	if index, exists := b.indexes[b.hashes[node]]; exists {
+		return models.PlanArgument{TaskID: b.tasks[index].ID}, index
+	}
+
+	arg1, child1 := b.add(node.Left)
+	arg2, child2 := b.add(node.Right)
+	level := 1
+	for _, child := range []int{child1, child2} {
+		if child >= 0 {
+			level = max(level, b.tasks[child].Level+1)
+		}
+	}
+
+	index := len(b.tasks)
+	b.tasks = append(b.tasks, models.PlanTask{
+		ID:            "t" + strconv.Itoa(index+1),
+		Operation:     node.Value,
+		Arg1:          arg1,
+		Arg2:          arg2,
+		OperationTime: b.timings.For(node.Value),
+		Level:         level,
+	})
+	b.parents = append(b.parents, nil)
+	for _, child := range []int{child1, child2} {
+		if child >= 0 {
+			b.parents[child] = append(b.parents[child], index)
+		}
+	}
+	b.indexes[b.hashes[node]] = index
+	return models.PlanArgument{TaskID: b.tasks[index].ID}, index
+}
+
+// criticalPaths fills in the operation time from every task to the root.
+// Tasks are created children first, so walking backwards visits all parents
+// of a task before the task itself.
+func (b *planBuilder) criticalPaths() {
+	for i := len(b.tasks) - 1; i >= 0; i-- {
+		longestParent := 0
+		for _, parent := range b.parents[i] {
+			longestParent = max(longestParent, b.tasks[parent].CriticalPath)
+		}
+		b.tasks[i].CriticalPath = b.tasks[i].OperationTime + longestParent
+	}
+}
+
+// estimate simulates agents picking ready tasks by critical path, as the
+// scheduler does, and returns the time until the last task finishes.
+func (b *planBuilder) estimate(agents int) int {
+	pending := make([]int, len(b.tasks))
+	var ready []int
+	for i, task := range b.tasks {
+		for _, arg := range []models.PlanArgument{task.Arg1, task.Arg2} {
+			if arg.TaskID != "" {
+				pending[i]++
+			}
+		}
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	type running struct{ task, finishAt int }
+	var inFlight []running
+	now := 0
+	for len(ready) > 0 || len(inFlight) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			return b.tasks[ready[i]].CriticalPath > b.tasks[ready[j]].CriticalPath
+		})
+		for len(inFlight) < agents && len(ready) > 0 {
+			inFlight = append(inFlight, running{ready[0], now + b.tasks[ready[0]].OperationTime})
+			ready = ready[1:]
+		}
+
+		sort.Slice(inFlight, func(i, j int) bool { return inFlight[i].finishAt < inFlight[j].finishAt })
+		now = inFlight[0].finishAt
+		for len(inFlight) > 0 && inFlight[0].finishAt == now {
+			for _, parent := range b.parents[inFlight[0].task] {
+				pending[parent]--
+				if pending[parent] == 0 {
+					ready = append(ready, parent)
+				}
+			}
+			inFlight = inFlight[1:]
+		}
+	}
+	return now
+}
+
+// Explain returns the execution plan of an expression without enqueuing it.
+func (s *APIService) Explain(request *models.ExplainRequest) (*models.ExplainResponse, error) {
+	tree, err := calc.ToTree(request.Expression)
+	if err != nil {
+		return nil, err
+	}
+	if request.Optimize || s.OptimizeExpressions {
+		tree = calc.Optimize(tree)
+	}
+
+	builder := &planBuilder{
+		timings: s.OperationTimings(),
+		hashes:  tree.Hashes(),
+		indexes: make(map[string]int),
+		tasks:   []models.PlanTask{},
+	}
+	builder.add(&tree)
+	builder.criticalPaths()
+
+	agents := request.Agents
+	if agents < 1 {
+		agents = max(s.ActiveAgents(), 1)
+	}
+	response := &models.ExplainResponse{
+		AST:         &tree,
+		Infix:       tree.Infix(),
+		Tasks:       builder.tasks,
+		Agents:      agents,
+		EstimatedMs: builder.estimate(agents),
+	}
+	width := make(map[int]int)
+	for _, task := range builder.tasks {
+		response.Depth = max(response.Depth, task.Level)
+		width[task.Level]++
+		response.Width = max(response.Width, width[task.Level])
+	}
+	return response, nil
+}
@@ -1,7 +1,10 @@
 package orchestrator
 
 import (
+	"bytes"
+	"calc-website/config"
 	"calc-website/internal/models"
+	"calc-website/pkg/tracing"
 	"calc-website/pkg/utils"
 	"encoding/json"
 	"io"
@@ -23,10 +26,29 @@ func (h *APIHandler) Router() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/calculate", h.Calculate)
 	mux.HandleFunc("/api/v1/expressions", h.GetExpressions)
-	mux.HandleFunc("/api/v1/expressions/{id}", h.GetExpressionByID)
+	mux.HandleFunc("/api/v1/expressions/{id}", h.ExpressionHandler)
+	mux.HandleFunc("/api/v1/expressions/{id}/deliveries", h.GetWebhookDeliveries)
+	mux.HandleFunc("/api/v1/expressions/{id}/trace", h.GetExpressionTrace)
+	mux.HandleFunc("/api/v1/expressions/{id}/priority", h.SetExpressionPriority)
+	mux.HandleFunc("/api/v1/explain", h.Explain)
+	mux.HandleFunc("/api/v1/cache", h.GetCacheStats)
+	mux.HandleFunc("/api/v1/admin/timings", h.requireAdmin(h.Timings))
 	mux.HandleFunc("/internal/task", h.TaskHandler)
+	mux.HandleFunc("/internal/task/{id}/return", h.ReturnTask)
+	mux.HandleFunc("/healthz", h.Health)
+	mux.HandleFunc("/readyz", h.Ready)
+	mux.Handle("/metrics", h.Service.metrics.registry)
 
-	return mux
+	return withRequestID(h.Service.metrics.instrument(mux))
+}
+
+func decodeJSON(r *http.Request, value any) error {
+	body, err := io.ReadAll(r.Body)
+	defer utils.CloseResponseBody(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, value)
 }
 
 func (h *APIHandler) TaskHandler(w http.ResponseWriter, r *http.Request) {
@@ -36,115 +58,334 @@ func (h *APIHandler) TaskHandler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPost:
 		h.PostTask(w, r)
 	default:
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, ErrMethodNotAllowed, nil)
+	}
+}
+
+func (h *APIHandler) ExpressionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.GetExpressionByID(w, r)
+	case http.MethodDelete:
+		h.DeleteExpression(w, r)
+	default:
+		writeError(w, r, ErrMethodNotAllowed, nil)
 	}
 }
 
 func (h *APIHandler) GetTask(w http.ResponseWriter, r *http.Request) {
-	task := h.Service.GetTask()
+	if h.Service.Draining() {
+		writeError(w, r, ErrShuttingDown, nil)
+		return
+	}
+	if r.URL.Query().Has("max") {
+		h.GetTasks(w, r)
+		return
+	}
+	task := h.Service.GetTask(r.Context(), r.Header.Get(models.AgentIDHeader))
+	w.Header().Set(models.QueueDepthHeader, strconv.Itoa(h.Service.QueueDepth()))
 	if task == nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		err := json.NewEncoder(w).Encode(map[string]any{"message": "tasks not found"})
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
-		}
+		writeError(w, r, ErrNoTasks, nil)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	err := json.NewEncoder(w).Encode(task)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	if task.TraceParent != "" {
+		w.Header().Set(tracing.Header, task.TraceParent)
+	}
+	writeJSON(w, http.StatusOK, task)
+}
+
+// GetTasks hands out a batch of up to ?max= tasks.
+func (h *APIHandler) GetTasks(w http.ResponseWriter, r *http.Request) {
+	max, err := strconv.Atoi(r.URL.Query().Get("max"))
+	if err != nil || max < 1 || max > config.MaxBatchSize {
+		writeError(w, r, ErrRequestInvalid, "max must be between 1 and "+strconv.Itoa(config.MaxBatchSize))
+		return
+	}
+	workers, _ := strconv.Atoi(r.Header.Get(models.AgentWorkersHeader))
+	tasks := h.Service.GetTasks(r.Context(), r.Header.Get(models.AgentIDHeader), workers, max)
+	w.Header().Set(models.QueueDepthHeader, strconv.Itoa(h.Service.QueueDepth()))
+	if len(tasks) == 0 {
+		writeError(w, r, ErrNoTasks, nil)
+		return
 	}
+	writeJSON(w, http.StatusOK, models.TaskBatch{Tasks: tasks})
 }
 
+// PostTask accepts a single result or, as a JSON array, a batch of results.
 func (h *APIHandler) PostTask(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
-	defer utils.CloseResponseBody(r.Body)
+	utils.CloseResponseBody(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, ErrRequestInvalid, err.Error())
+		return
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		h.postTaskBatch(w, r, body)
+		return
 	}
 
 	var result models.TaskResult
 	err = json.Unmarshal(body, &result)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		writeError(w, r, ErrRequestInvalid, err.Error())
+		return
 	}
 
-	taskID, err := strconv.ParseUint(result.TaskID, 10, 32)
-	err = h.Service.ConfirmTask(uint32(taskID), result.Result)
+	parent, _ := tracing.Parse(r.Header.Get(tracing.Header))
+	span := h.Service.tracer.Start("confirm task", parent)
+	span.SetAttribute("task_id", string(result.TaskID))
+	defer span.End()
+
+	err = h.Service.reportResult(r.Context(), result)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		span.SetAttribute("error", err.Error())
+		writeError(w, r, err, nil)
+		return
 	}
 }
 
+func (h *APIHandler) postTaskBatch(w http.ResponseWriter, r *http.Request, body []byte) {
+	var results []models.TaskResult
+	if err := json.Unmarshal(body, &results); err != nil {
+		writeError(w, r, ErrRequestInvalid, err.Error())
+		return
+	}
+	if len(results) > config.MaxBatchSize {
+		writeError(w, r, ErrRequestInvalid, "at most "+strconv.Itoa(config.MaxBatchSize)+" results per batch")
+		return
+	}
+
+	response := models.ResultBatchResponse{Accepted: []models.ID{}, Rejected: []models.ID{}}
+	for _, result := range results {
+		parent, _ := tracing.Parse(result.TraceParent)
+		span := h.Service.tracer.Start("confirm task", parent)
+		span.SetAttribute("task_id", string(result.TaskID))
+		if err := h.Service.reportResult(r.Context(), result); err != nil {
+			span.SetAttribute("error", err.Error())
+			response.Rejected = append(response.Rejected, result.TaskID)
+		} else {
+			response.Accepted = append(response.Accepted, result.TaskID)
+		}
+		span.End()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *APIHandler) ReturnTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, ErrMethodNotAllowed, nil)
+		return
+	}
+	id, err := models.ParseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	err = h.Service.ReturnTask(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Health reports that the process is alive.
+func (h *APIHandler) Health(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Ready reports whether the orchestrator accepts new work; it fails once
+// shutdown has started.
+func (h *APIHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	if h.Service.Draining() {
+		writeError(w, r, ErrShuttingDown, nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
 func (h *APIHandler) Calculate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, ErrMethodNotAllowed, nil)
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
-	defer utils.CloseResponseBody(r.Body)
+	var expression models.ExpressionRequest
+	err := decodeJSON(r, &expression)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		writeError(w, r, ErrRequestInvalid, err.Error())
 		return
 	}
+	expression.TraceParent = r.Header.Get(tracing.Header)
 
-	var expression models.ExpressionRequest
-	err = json.Unmarshal(body, &expression)
+	expressionID, err := h.Service.CreateTasks(r.Context(), &expression)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		writeError(w, r, err, nil)
+		return
+	}
+	writeJSON(w, http.StatusCreated,
+		map[string]any{"expression": models.ExpressionResponse{ExpressionID: expressionID}})
+}
+
+func (h *APIHandler) Explain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, ErrMethodNotAllowed, nil)
 		return
 	}
 
-	expressionID, err := h.Service.CreateTasks(expression.Expression)
+	var request models.ExplainRequest
+	err := decodeJSON(r, &request)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		writeError(w, r, ErrRequestInvalid, err.Error())
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	err = json.NewEncoder(w).Encode(
-		map[string]any{"expression": models.ExpressionResponse{ExpressionID: strconv.Itoa(int(expressionID))}})
+
+	plan, err := h.Service.Explain(&request)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		writeError(w, r, err, nil)
 		return
 	}
+	writeJSON(w, http.StatusOK, map[string]any{"plan": plan})
 }
 
 func (h *APIHandler) GetExpressions(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, ErrMethodNotAllowed, nil)
 		return
 	}
 	expressions := h.Service.GetAllExpressions()
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	err := json.NewEncoder(w).Encode(map[string]any{"expressions": expressions})
+	writeJSON(w, http.StatusOK, map[string]any{"expressions": expressions})
+}
+
+func (h *APIHandler) GetExpressionByID(w http.ResponseWriter, r *http.Request) {
+	id, err := models.ParseID(r.PathValue("id"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err, nil)
 		return
 	}
+	expression := h.Service.GetExpressionByID(id)
+	if expression == nil {
+		writeError(w, r, ErrIDExpressionNotExists, nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"expression": expression})
 }
 
-func (h *APIHandler) GetExpressionByID(w http.ResponseWriter, r *http.Request) {
+func (h *APIHandler) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, ErrMethodNotAllowed, nil)
+		return
+	}
+	id, err := models.ParseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	deliveries, exists := h.Service.GetWebhookDeliveries(id)
+	if !exists {
+		writeError(w, r, ErrIDExpressionNotExists, nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"deliveries": deliveries})
+}
+
+func (h *APIHandler) GetExpressionTrace(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, ErrMethodNotAllowed, nil)
 		return
 	}
-	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	id, err := models.ParseID(r.PathValue("id"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		writeError(w, r, err, nil)
 		return
 	}
-	expression := h.Service.GetExpressionByID(uint32(id))
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(map[string]any{"expression": expression})
+	trace, err := h.Service.GetExpressionTrace(id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err, nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"trace": trace})
+}
+
+func (h *APIHandler) GetCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, ErrMethodNotAllowed, nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"cache": h.Service.GetCacheStats()})
+}
+
+func (h *APIHandler) SetExpressionPriority(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, r, ErrMethodNotAllowed, nil)
 		return
 	}
+	id, err := models.ParseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+
+	var request models.PriorityRequest
+	err = decodeJSON(r, &request)
+	if err != nil {
+		writeError(w, r, ErrRequestInvalid, err.Error())
+		return
+	}
+
+	expression, err := h.Service.SetExpressionPriority(id, request.Priority)
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"expression": expression})
+}
+
+func (h *APIHandler) DeleteExpression(w http.ResponseWriter, r *http.Request) {
+	id, err := models.ParseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	err = h.Service.DeleteExpression(id)
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireAdmin allows requests carrying the configured admin token as a
+// bearer token. Without a configured token the admin API is disabled.
+func (h *APIHandler) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !utils.BearerTokenValid(r.Header.Get("Authorization"), h.Service.AdminToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, r, ErrUnauthorized, nil)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (h *APIHandler) Timings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"timings": h.Service.OperationTimings()})
+	case http.MethodPut:
+		var update models.TimingsUpdate
+		err := decodeJSON(r, &update)
+		if err != nil {
+			writeError(w, r, ErrRequestInvalid, err.Error())
+			return
+		}
+		timings, err := h.Service.UpdateOperationTimings(r.Context(), update)
+		if err != nil {
+			writeError(w, r, err, nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"timings": timings})
+	default:
+		writeError(w, r, ErrMethodNotAllowed, nil)
+	}
 }
@@ -0,0 +1,113 @@
+package orchestrator
+
+import (
+	"calc-website/internal/models"
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// RunJanitor purges finished expressions according to the retention policy
+// every interval until ctx is done.
+func (s *APIService) RunJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if purged := s.PurgeExpressions(now); purged > 0 {
+				slog.Info("janitor purged expressions", "count", purged)
+			}
+		}
+	}
+}
+
+// PurgeExpressions removes finished expressions older than RetentionMaxAge and
+// the oldest finished expressions of users that keep more than
+// RetentionMaxPerUser of them. It returns the number of purged expressions.
+func (s *APIService) PurgeExpressions(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	finishedByUser := make(map[string][]*models.Expression)
+	for _, expression := range s.allExpressions {
+		if expression.IsFinished() {
+			finishedByUser[expression.User] = append(finishedByUser[expression.User], expression)
+		}
+	}
+
+	purged := 0
+	for _, expressions := range finishedByUser {
+		// IDs are time ordered, so the newest expressions come first
+		sort.Slice(expressions, func(i, j int) bool {
+			return expressions[i].ID > expressions[j].ID
+		})
+		for i, expression := range expressions {
+			expired := s.RetentionMaxAge > 0 && now.Sub(*expression.FinishedAt) > s.RetentionMaxAge
+			overLimit := s.RetentionMaxPerUser > 0 && i >= s.RetentionMaxPerUser
+			if expired || overLimit {
+				s.purgeExpression(expression.ID)
+				purged++
+			}
+		}
+	}
+	return purged
+}
+
+func (s *APIService) DeleteExpression(expressionID models.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expression, exists := s.allExpressions[expressionID]
+	if !exists {
+		return ErrIDExpressionNotExists
+	}
+	if !expression.IsFinished() {
+		return ErrExpressionNotFinished
+	}
+	s.purgeExpression(expressionID)
+	return nil
+}
+
+// purgeExpression must be called with s.mu held and only for finished
+// expressions. Tasks of a failed expression may still be computing; they
+// are kept until their results arrive. Shared tasks are kept while another
+// expression that traces them exists.
+func (s *APIService) purgeExpression(expressionID models.ID) {
+	for _, taskID := range s.expressionTasks[expressionID] {
+		task, exists := s.allTasks[taskID]
+		if !exists || !task.Confirmed || s.tracedByOthers(task, expressionID) {
+			continue
+		}
+		s.forgetTask(task)
+	}
+	delete(s.expressionTasks, expressionID)
+	delete(s.webhookDeliveries, expressionID)
+	delete(s.allExpressions, expressionID)
+}
+
+// dropOrphan forgets a released task that no remaining expression traces,
+// such as a subtree of a failed expression that was removed while the
+// subtree was still computing.
+func (s *APIService) dropOrphan(task *models.Task) {
+	if !s.tracedByOthers(task, "") {
+		s.forgetTask(task)
+	}
+}
+
+func (s *APIService) forgetTask(task *models.Task) {
+	delete(s.taskArgs, task.Arg1ID)
+	delete(s.taskArgs, task.Arg2ID)
+	delete(s.allTasks, task.ID)
+}
+
+func (s *APIService) tracedByOthers(task *models.Task, expressionID models.ID) bool {
+	for _, otherID := range append([]models.ID{task.ExpressionID}, task.SharedWith...) {
+		if _, exists := s.allExpressions[otherID]; exists && otherID != expressionID {
+			return true
+		}
+	}
+	return false
+}
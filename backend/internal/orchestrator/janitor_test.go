@@ -0,0 +1,133 @@
+package orchestrator
+
+import (
+	"calc-website/config"
+	"calc-website/internal/models"
+	"calc-website/pkg/calc"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func computeAll(t *testing.T, s *APIService) {
+	t.Helper()
+	for task := s.GetTask(context.Background(), "test"); task != nil; task = s.GetTask(context.Background(), "test") {
+		result, _ := calc.Compute(task.Arg1, task.Arg2, task.Operation)
+		if err := s.ConfirmTask(context.Background(), task.ID, result); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPurgeExpressions(t *testing.T) {
+	s := NewAPIService(&config.Config{RetentionMaxAgeMs: 60 * 60 * 1000, RetentionMaxPerUser: 1})
+
+	var ids []models.ID
+	for _, expression := range []string{"1 + 2 * 3", "4 - 5", "6 / 7 + 8"} {
+		id, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: expression, User: "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	computeAll(t, s)
+
+	if purged := s.PurgeExpressions(time.Now()); purged != 2 {
+		t.Errorf("PurgeExpressions() = %d, expected 2 expressions over the per-user limit", purged)
+	}
+	if s.GetExpressionByID(ids[2]) == nil {
+		t.Error("the newest expression was purged")
+	}
+	if len(s.allTasks) != 2 || len(s.taskArgs) != 4 {
+		t.Errorf("%d tasks and %d arguments left, expected 2 and 4", len(s.allTasks), len(s.taskArgs))
+	}
+
+	if purged := s.PurgeExpressions(time.Now().Add(2 * time.Hour)); purged != 1 {
+		t.Errorf("PurgeExpressions() = %d, expected 1 expired expression", purged)
+	}
+	if len(s.allExpressions) != 0 || len(s.allTasks) != 0 || len(s.taskArgs) != 0 || len(s.expressionTasks) != 0 {
+		t.Error("state is not empty after all expressions were purged")
+	}
+}
+
+func TestWebhookStopsAfterDelete(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer callback.Close()
+
+	s := NewAPIService(&config.Config{WebhookMaxAttempts: 3, WebhookBackoffMs: 100, WebhookSecret: "secret"})
+	id, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: "1 + 2", CallbackURL: callback.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	computeAll(t, s)
+	for deliveries, _ := s.GetWebhookDeliveries(id); len(deliveries) == 0; deliveries, _ = s.GetWebhookDeliveries(id) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.DeleteExpression(id); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 1 {
+		t.Errorf("callback received %d attempts, expected retries to stop after the delete", attempts)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.webhookDeliveries[id]; exists {
+		t.Error("delivery log recreated for a deleted expression")
+	}
+}
+
+func TestSharedTasksTracedAndKept(t *testing.T) {
+	s := NewAPIService(&config.Config{})
+	var ids []models.ID
+	for range 2 {
+		id, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: "(1 + 2) * 3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	computeAll(t, s)
+
+	trace, err := s.GetExpressionTrace(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace) != 2 {
+		t.Errorf("trace of the shared expression has %d tasks, expected 2", len(trace))
+	}
+
+	if err := s.DeleteExpression(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	trace, err = s.GetExpressionTrace(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace) != 2 {
+		t.Errorf("trace has %d tasks after the first expression was deleted, expected 2", len(trace))
+	}
+
+	if err := s.DeleteExpression(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.allTasks) != 0 || len(s.taskArgs) != 0 {
+		t.Errorf("%d tasks and %d arguments left, expected the last expression to purge them",
+			len(s.allTasks), len(s.taskArgs))
+	}
+}
@@ -0,0 +1,78 @@
+package orchestrator
+
+import (
+	"calc-website/internal/models"
+	"calc-website/pkg/calc"
+	"calc-website/pkg/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultLanguage = "en"
+
+// messageCatalogs holds the client-facing text of every mapped error. The
+// English catalog falls back to the error text itself.
+var messageCatalogs = map[string]map[error]string{
+	"en": {},
+	"ru": {
+		calc.ErrExpressionInvalid: "выражение некорректно",
+		utils.ErrArrayEmpty:       "выражение некорректно",
+		calc.ErrDivisionByZero:    "деление на ноль",
+		calc.ErrUnknownOperator:   "неизвестный оператор",
+		ErrRequestInvalid:         "некорректное тело запроса",
+		models.ErrIDInvalid:       "некорректный идентификатор",
+		ErrCallbackURLInvalid:     "некорректный адрес для уведомления",
+		ErrCallbacksDisabled:      "уведомления отключены: не задан ключ подписи",
+		ErrPriorityInvalid:        "приоритет должен быть high, normal или low",
+		ErrIDExpressionNotExists:  "выражение с таким идентификатором не существует",
+		ErrIDTaskNotExists:        "задача с таким идентификатором не существует",
+		ErrNoTasks:                "задачи не найдены",
+		ErrExpressionNotFinished:  "выражение ещё не вычислено",
+		ErrMethodNotAllowed:       "метод не поддерживается",
+		ErrBacklogFull:            "слишком много невыполненных задач, повторите позже",
+		ErrShuttingDown:           "сервер завершает работу",
+		ErrUnauthorized:           "требуется авторизация",
+		ErrTimingInvalid:          "время операции не может быть отрицательным",
+		ErrInternal:               "внутренняя ошибка сервера",
+	},
+}
+
+func localizedMessage(err error, language string) string {
+	if message, exists := messageCatalogs[language][err]; exists {
+		return message
+	}
+	return err.Error()
+}
+
+// negotiateLanguage picks the supported language with the highest weight in
+// an Accept-Language header, e.g. "ru-RU,ru;q=0.9,en;q=0.8".
+func negotiateLanguage(header string) string {
+	type candidate struct {
+		language string
+		weight   float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		language, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		weight := 1.0
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			weight = parsed
+		}
+		if _, supported := messageCatalogs[language]; supported && weight > 0 {
+			candidates = append(candidates, candidate{language, weight})
+		}
+	}
+	if len(candidates) == 0 {
+		return defaultLanguage
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].weight > candidates[j].weight
+	})
+	return candidates[0].language
+}
@@ -0,0 +1,91 @@
+package orchestrator
+
+import (
+	"calc-website/pkg/metrics"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type serviceMetrics struct {
+	registry           *metrics.Registry
+	tasksDispatched    *metrics.CounterVec
+	tasksCached        *metrics.CounterVec
+	tasksConfirmed     *metrics.CounterVec
+	tasksFailed        *metrics.CounterVec
+	leasesExpired      *metrics.CounterVec
+	resultsRejected    *metrics.CounterVec
+	expressionDuration *metrics.HistogramVec
+	httpDuration       *metrics.HistogramVec
+}
+
+func newServiceMetrics(s *APIService) *serviceMetrics {
+	registry := metrics.NewRegistry()
+	registry.NewGaugeFunc("calc_queue_depth", "Tasks waiting in the queue for an agent.", func() float64 {
+		return float64(s.QueueDepth())
+	})
+	registry.NewGaugeFunc("calc_backlog_tasks", "Created tasks that are not confirmed yet.", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(s.backlog)
+	})
+	registry.NewGaugeFunc("calc_active_agents", "Agent workers that polled for tasks recently.", func() float64 {
+		return float64(s.ActiveAgents())
+	})
+	return &serviceMetrics{
+		registry: registry,
+		tasksDispatched: registry.NewCounterVec("calc_tasks_dispatched_total",
+			"Tasks leased to agents.", "operation"),
+		tasksCached: registry.NewCounterVec("calc_tasks_cached_total",
+			"Tasks resolved from the result cache without an agent.", "operation"),
+		tasksConfirmed: registry.NewCounterVec("calc_tasks_confirmed_total",
+			"Task results accepted from agents.", "operation"),
+		tasksFailed: registry.NewCounterVec("calc_tasks_failed_total",
+			"Tasks whose computation failed on an agent.", "operation"),
+		leasesExpired: registry.NewCounterVec("calc_task_leases_expired_total",
+			"Leased tasks queued again because their agent did not report back in time.", "operation"),
+		resultsRejected: registry.NewCounterVec("calc_task_results_rejected_total",
+			"Task results and failures rejected because the task is unknown."),
+		expressionDuration: registry.NewHistogramVec("calc_expression_duration_seconds",
+			"Time from expression submission to its result.", metrics.DefBuckets, "priority"),
+		httpDuration: registry.NewHistogramVec("calc_http_request_duration_seconds",
+			"HTTP request durations by route.", metrics.DefBuckets, "route", "method", "code"),
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument records the duration of every request under the ServeMux
+// pattern that handled it, so path parameters do not multiply the series.
+func (m *serviceMetrics) instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(recorder, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		m.httpDuration.Observe(time.Since(start).Seconds(), route, methodLabel(r.Method), strconv.Itoa(recorder.status))
+	})
+}
+
+// methodLabel bounds the method label, since clients may send any method.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return method
+	default:
+		return "other"
+	}
+}
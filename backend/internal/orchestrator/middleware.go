@@ -0,0 +1,34 @@
+package orchestrator
+
+import (
+	"calc-website/internal/models"
+	"calc-website/pkg/logging"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const maxRequestIDLength = 128
+
+// withRequestID tags every request with the ID from logging.RequestIDHeader,
+// or a new one, returns it in the response and logs the request at debug level.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(logging.RequestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = string(models.NewID())
+		}
+		w.Header().Set(logging.RequestIDHeader, requestID)
+		ctx := logging.WithRequestID(r.Context(), requestID)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		slog.DebugContext(ctx, "http request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"agent_id", r.Header.Get(models.AgentIDHeader))
+	})
+}
@@ -0,0 +1,40 @@
+package orchestrator
+
+import (
+	"calc-website/config"
+	"calc-website/internal/models"
+	"context"
+	"time"
+)
+
+// ApplyConfig applies the reloaded settings the orchestrator uses. Only the
+// changed operation times are replaced, so times set through the admin API
+// survive a reload that does not touch them.
+func (s *APIService) ApplyConfig(cfg *config.Config, changes []config.Change) error {
+	var update models.TimingsUpdate
+	s.mu.Lock()
+	for _, change := range changes {
+		switch change.Key {
+		case "time_addition_ms":
+			update.AdditionMs = &cfg.TimeAdditionMs
+		case "time_subtraction_ms":
+			update.SubtractionMs = &cfg.TimeSubtractionMs
+		case "time_multiplications_ms":
+			update.MultiplicationMs = &cfg.TimeMultiplicationsMs
+		case "time_divisions_ms":
+			update.DivisionMs = &cfg.TimeDivisionsMs
+		case "max_backlog":
+			s.MaxBacklog = cfg.MaxBacklog
+		case "max_leased_per_expression":
+			s.tasksQueue.maxLeased = cfg.MaxLeasedPerExpr
+		case "task_lease_timeout_ms":
+			s.LeaseTimeout = time.Duration(cfg.TaskLeaseTimeoutMs) * time.Millisecond
+		}
+	}
+	s.mu.Unlock()
+	if update == (models.TimingsUpdate{}) {
+		return nil
+	}
+	_, err := s.UpdateOperationTimings(context.Background(), update)
+	return err
+}
@@ -0,0 +1,37 @@
+package orchestrator
+
+import (
+	"calc-website/config"
+	"calc-website/internal/models"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestApplyConfig(t *testing.T) {
+	cfg := &config.Config{TimeAdditionMs: 100, TimeSubtractionMs: 100, MaxBacklog: 10}
+	s := NewAPIService(cfg)
+	subtraction := 300
+	if _, err := s.UpdateOperationTimings(context.Background(), models.TimingsUpdate{SubtractionMs: &subtraction}); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := *cfg
+	updated.TimeAdditionMs = 200
+	updated.MaxBacklog = 1
+	updated.MaxLeasedPerExpr = 1
+	if err := s.ApplyConfig(&updated, config.Diff(cfg, &updated)); err != nil {
+		t.Fatal(err)
+	}
+	// the subtraction time set through the admin API is kept
+	expected := models.OperationTimings{AdditionMs: 200, SubtractionMs: 300}
+	if timings := s.OperationTimings(); timings != expected {
+		t.Errorf("OperationTimings() = %+v, expected %+v", timings, expected)
+	}
+	if s.tasksQueue.maxLeased != 1 {
+		t.Errorf("maxLeased = %d, expected 1", s.tasksQueue.maxLeased)
+	}
+	if _, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: "1 + 2 + 3"}); !errors.Is(err, ErrBacklogFull) {
+		t.Errorf("CreateTasks() = %v, expected the new backlog limit to apply", err)
+	}
+}
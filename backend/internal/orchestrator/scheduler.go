@@ -0,0 +1,253 @@
+package orchestrator
+
+import (
+	"calc-website/internal/models"
+	"container/heap"
+	"time"
+)
+
+type queuedTask struct {
+	task       *models.Task
+	seq        uint64
+	index      int
+	enqueuedAt time.Time
+}
+
+// taskHeap orders the ready tasks of one expression by remaining critical
+// path, longest first, falling back to enqueue order.
+type taskHeap []*queuedTask
+
+func (h taskHeap) Len() int { return len(h) }
+
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].task.CriticalPath != h[j].task.CriticalPath {
+		return h[i].task.CriticalPath > h[j].task.CriticalPath
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h taskHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *taskHeap) Push(x any) {
+	item := x.(*queuedTask)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *taskHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// userState tracks the virtual time of one user for weighted fair queuing:
+// every dispatched task advances it by operation time divided by weight.
+type userState struct {
+	virtualTime float64
+	active      int
+}
+
+// scheduler hands out ready tasks. Expressions with a higher priority go
+// first; a waiting task gains one priority level per aging interval so low
+// priorities are never starved. Equal priorities are shared between users by
+// weighted fair queuing. Within a user, expressions with fewer leased tasks
+// are served first, and the task with the longest remaining critical path
+// wins. An expression never holds more than maxLeased leases at once (0 means
+// no limit). It is not safe for concurrent use.
+type scheduler struct {
+	queues      map[models.ID]*taskHeap
+	items       map[models.ID]*queuedTask
+	leased      map[models.ID]int
+	priorities  map[models.ID]int
+	users       map[string]*userState
+	weights     map[string]int
+	maxLeased   int
+	aging       time.Duration
+	virtualTime float64
+	seq         uint64
+	now         func() time.Time
+}
+
+func newScheduler(weights map[string]int, maxLeased int, aging time.Duration) *scheduler {
+	if weights == nil {
+		weights = make(map[string]int)
+	}
+	return &scheduler{
+		queues:     make(map[models.ID]*taskHeap),
+		items:      make(map[models.ID]*queuedTask),
+		leased:     make(map[models.ID]int),
+		priorities: make(map[models.ID]int),
+		users:      make(map[string]*userState),
+		weights:    weights,
+		maxLeased:  maxLeased,
+		aging:      aging,
+		now:        time.Now,
+	}
+}
+
+func (q *scheduler) Len() int {
+	return len(q.items)
+}
+
+// Leased returns the number of tasks handed out by Pop and not released yet.
+func (q *scheduler) Leased() int {
+	leased := 0
+	for _, count := range q.leased {
+		leased += count
+	}
+	return leased
+}
+
+func (q *scheduler) Push(task *models.Task) {
+	if _, queued := q.items[task.ID]; queued {
+		return
+	}
+	queue, exists := q.queues[task.ExpressionID]
+	if !exists {
+		queue = &taskHeap{}
+		q.queues[task.ExpressionID] = queue
+	}
+	q.seq++
+	item := &queuedTask{task: task, seq: q.seq, enqueuedAt: q.now()}
+	heap.Push(queue, item)
+	q.items[task.ID] = item
+	q.activate(task.User)
+}
+
+// Update restores the ordering after the critical path of a queued task changed.
+func (q *scheduler) Update(task *models.Task) {
+	if item, queued := q.items[task.ID]; queued {
+		heap.Fix(q.queues[task.ExpressionID], item.index)
+	}
+}
+
+// SetPriority sets the priority level of an expression's tasks, including
+// the ones already queued.
+func (q *scheduler) SetPriority(expressionID models.ID, level int) {
+	q.priorities[expressionID] = level
+}
+
+// Forget drops the priority of a finished expression.
+func (q *scheduler) Forget(expressionID models.ID) {
+	delete(q.priorities, expressionID)
+}
+
+// Pop removes the next task to run and marks it as leased.
+func (q *scheduler) Pop() *models.Task {
+	now := q.now()
+	var bestID models.ID
+	var best *queuedTask
+	var bestPriority int
+	for expressionID, queue := range q.queues {
+		if q.maxLeased > 0 && q.leased[expressionID] >= q.maxLeased {
+			continue
+		}
+		head := (*queue)[0]
+		priority := q.effectivePriority(expressionID, head, now)
+		if best == nil || priority > bestPriority ||
+			(priority == bestPriority && q.before(expressionID, head, bestID, best)) {
+			bestID, best, bestPriority = expressionID, head, priority
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	queue := q.queues[bestID]
+	heap.Pop(queue)
+	if queue.Len() == 0 {
+		delete(q.queues, bestID)
+	}
+	delete(q.items, best.task.ID)
+	q.leased[bestID]++
+
+	user := q.users[best.task.User]
+	q.virtualTime = user.virtualTime
+	user.virtualTime += float64(max(best.task.OperationTime, 1)) / float64(q.weight(best.task.User))
+	return best.task
+}
+
+// Release forgets a finished task: it ends the lease taken by Pop or, if the
+// result arrived while the task was still queued, removes it from the queue.
+func (q *scheduler) Release(task *models.Task) {
+	if item, queued := q.items[task.ID]; queued {
+		queue := q.queues[task.ExpressionID]
+		heap.Remove(queue, item.index)
+		if queue.Len() == 0 {
+			delete(q.queues, task.ExpressionID)
+		}
+		delete(q.items, task.ID)
+		q.deactivate(task.User)
+		return
+	}
+	if !task.Leased {
+		return
+	}
+	q.leased[task.ExpressionID]--
+	if q.leased[task.ExpressionID] <= 0 {
+		delete(q.leased, task.ExpressionID)
+	}
+	q.deactivate(task.User)
+}
+
+func (q *scheduler) effectivePriority(expressionID models.ID, head *queuedTask, now time.Time) int {
+	maxLevel, _ := models.PriorityLevel(models.PriorityHigh)
+	level, exists := q.priorities[expressionID]
+	if !exists {
+		level, _ = models.PriorityLevel(models.PriorityNormal)
+	}
+	if q.aging > 0 {
+		level += int(now.Sub(head.enqueuedAt) / q.aging)
+	}
+	return min(level, maxLevel)
+}
+
+func (q *scheduler) weight(user string) int {
+	if weight, exists := q.weights[user]; exists {
+		return weight
+	}
+	return 1
+}
+
+// activate counts a queued or leased task of the user. A user that was idle
+// starts at the current virtual time instead of spending credit saved up
+// while it had nothing to run.
+func (q *scheduler) activate(user string) {
+	state, exists := q.users[user]
+	if !exists {
+		state = &userState{virtualTime: q.virtualTime}
+		q.users[user] = state
+	}
+	state.active++
+}
+
+func (q *scheduler) deactivate(user string) {
+	state, exists := q.users[user]
+	if !exists {
+		return
+	}
+	state.active--
+	if state.active <= 0 {
+		delete(q.users, user)
+	}
+}
+
+func (q *scheduler) before(expressionID models.ID, head *queuedTask, bestID models.ID, best *queuedTask) bool {
+	if head.task.User != best.task.User {
+		headTime := q.users[head.task.User].virtualTime
+		bestTime := q.users[best.task.User].virtualTime
+		if headTime != bestTime {
+			return headTime < bestTime
+		}
+	}
+	if q.leased[expressionID] != q.leased[bestID] {
+		return q.leased[expressionID] < q.leased[bestID]
+	}
+	return taskHeap{head, best}.Less(0, 1)
+}
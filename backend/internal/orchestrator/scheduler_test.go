@@ -0,0 +1,78 @@
+package orchestrator
+
+import (
+	"calc-website/internal/models"
+	"testing"
+	"time"
+)
+
+func pushTasks(q *scheduler, user string, expressionID models.ID, count int) {
+	for i := 0; i < count; i++ {
+		q.Push(&models.Task{
+			ID:            models.NewID(),
+			ExpressionID:  expressionID,
+			User:          user,
+			OperationTime: 100,
+			CriticalPath:  100,
+		})
+	}
+}
+
+func TestSchedulerWeightedFairness(t *testing.T) {
+	q := newScheduler(map[string]int{"alice": 2}, 0, 0)
+	pushTasks(q, "alice", "e1", 100)
+	pushTasks(q, "bob", "e2", 100)
+	pushTasks(q, "bob", "e3", 100)
+
+	served := map[string]int{}
+	expressions := map[models.ID]int{}
+	for i := 0; i < 30; i++ {
+		task := q.Pop()
+		task.Leased = true
+		served[task.User]++
+		expressions[task.ExpressionID]++
+	}
+
+	if served["alice"] != 20 || served["bob"] != 10 {
+		t.Errorf("served %v, expected alice 20 and bob 10 for weights 2:1", served)
+	}
+	if expressions["e2"] != 5 || expressions["e3"] != 5 {
+		t.Errorf("bob's expressions served %d and %d times, expected 5 each", expressions["e2"], expressions["e3"])
+	}
+}
+
+func TestSchedulerLeaseCap(t *testing.T) {
+	q := newScheduler(nil, 2, 0)
+	pushTasks(q, "", "e1", 5)
+
+	first, second := q.Pop(), q.Pop()
+	first.Leased, second.Leased = true, true
+	if task := q.Pop(); task != nil {
+		t.Fatalf("Pop() = task %s, expected nil while the expression holds 2 leases", task.ID)
+	}
+
+	q.Release(first)
+	if task := q.Pop(); task == nil {
+		t.Error("Pop() = nil after a lease was released")
+	}
+}
+
+func TestSchedulerPriorityAging(t *testing.T) {
+	now := time.Now()
+	q := newScheduler(nil, 0, time.Second)
+	q.now = func() time.Time { return now }
+	q.SetPriority("e1", 0)
+	q.SetPriority("e2", 2)
+	pushTasks(q, "", "e1", 1)
+
+	now = now.Add(500 * time.Millisecond)
+	pushTasks(q, "", "e2", 2)
+	if task := q.Pop(); task.ExpressionID != "e2" {
+		t.Errorf("Pop() returned a task of expression %s, expected the high priority expression e2", task.ExpressionID)
+	}
+
+	now = now.Add(2 * time.Second)
+	if task := q.Pop(); task.ExpressionID != "e1" {
+		t.Errorf("Pop() returned a task of expression %s, expected the aged low priority expression e1", task.ExpressionID)
+	}
+}
@@ -3,153 +3,630 @@ package orchestrator
 import (
 	"calc-website/config"
 	"calc-website/internal/models"
+	"calc-website/pkg/cache"
 	"calc-website/pkg/calc"
+	"calc-website/pkg/tracing"
+	"context"
 	"errors"
-	"github.com/google/uuid"
+	"log/slog"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 )
 
-var ErrIDTaskNotExists = errors.New("task with this ID does not exist")
-
-var tasksQueue = make(chan *models.TaskResponse, 1024)
-var allTasks = make(map[uint32]*models.Task)
-var taskArgs = make(map[uint32]*models.Argument)
-var allExpressions = make(map[uint32]*models.Expression)
+var (
+	ErrIDTaskNotExists       = errors.New("task with this ID does not exist")
+	ErrIDExpressionNotExists = errors.New("expression with this ID does not exist")
+	ErrPriorityInvalid       = errors.New("priority must be high, normal or low")
+	ErrBacklogFull           = errors.New("too many unfinished tasks, try again later")
+	ErrExpressionNotFinished = errors.New("expression is not finished yet")
+	ErrShuttingDown          = errors.New("server is shutting down")
+)
 
 type APIService struct {
-	TimeAdditionMs        int
-	TimeSubtractionMs     int
-	TimeMultiplicationsMs int
-	TimeDivisionsMs       int
+	WebhookSecret       string
+	AdminToken          string
+	WebhookMaxAttempts  int
+	WebhookBackoffMs    int
+	OptimizeExpressions bool
+	MaxBacklog          int
+	RetentionMaxAge     time.Duration
+	RetentionMaxPerUser int
+	// LeaseTimeout is how long a task may stay leased beyond its operation
+	// time before it is queued again; 0 means forever
+	LeaseTimeout time.Duration
+
+	mu sync.Mutex
+	// timings are the operation times given to new tasks; they can be
+	// changed at runtime and are saved to timingsFile
+	timings        models.OperationTimings
+	timingsFile    string
+	tasksQueue     *scheduler
+	allTasks       map[models.ID]*models.Task
+	taskArgs       map[models.ID]*models.Argument
+	allExpressions map[models.ID]*models.Expression
+	// expressionTasks lists the tasks created for or shared with each expression
+	expressionTasks map[models.ID][]models.ID
+	// pendingSubtrees maps a structural subtree hash to the unfinished task
+	// that computes it, so identical subexpressions are scheduled only once.
+	pendingSubtrees   map[string]models.ID
+	webhookDeliveries map[models.ID][]*models.WebhookDelivery
+	results           *cache.LRU[string, float64]
+	// agents maps agent IDs to their last poll; a batch poll may stand
+	// for several workers
+	agents map[string]agentActivity
+	// leases holds the tasks currently leased to agents
+	leases map[models.ID]*models.Task
+	// backlog counts created tasks that are not confirmed yet
+	backlog int
+	metrics *serviceMetrics
+	tracer  *tracing.Tracer
+	// spans holds the open spans of unfinished expressions and tasks
+	spans map[models.ID]*tracing.ActiveSpan
+	// draining is set on shutdown: no new expressions are accepted and no
+	// more tasks are handed out
+	draining bool
 }
 
 func NewAPIService(cfg *config.Config) *APIService {
-	return &APIService{
-		TimeAdditionMs:        cfg.TimeAdditionMs,
-		TimeSubtractionMs:     cfg.TimeSubtractionMs,
-		TimeMultiplicationsMs: cfg.TimeMultiplicationsMs,
-		TimeDivisionsMs:       cfg.TimeDivisionsMs,
-	}
-}
-
-func getOperationTime(s *APIService, operator string) int {
-	switch operator {
-	case "+":
-		return s.TimeAdditionMs
-	case "-":
-		return s.TimeSubtractionMs
-	case "*":
-		return s.TimeMultiplicationsMs
-	case "/":
-		return s.TimeDivisionsMs
-	default:
-		return 0
+	aging := time.Duration(cfg.PriorityAgingMs) * time.Millisecond
+	cacheTTL := time.Duration(cfg.ResultCacheTTLMs) * time.Millisecond
+	exporter, err := tracing.NewExporter(cfg.TraceFile)
+	if err != nil {
+		slog.Error("open trace file error", "path", cfg.TraceFile, "error", err)
+		exporter = tracing.NopExporter{}
+	}
+	s := &APIService{
+		WebhookSecret:       cfg.WebhookSecret,
+		AdminToken:          cfg.AdminToken,
+		WebhookMaxAttempts:  cfg.WebhookMaxAttempts,
+		WebhookBackoffMs:    cfg.WebhookBackoffMs,
+		OptimizeExpressions: cfg.OptimizeExpressions,
+		MaxBacklog:          cfg.MaxBacklog,
+		RetentionMaxAge:     time.Duration(cfg.RetentionMaxAgeMs) * time.Millisecond,
+		RetentionMaxPerUser: cfg.RetentionMaxPerUser,
+		LeaseTimeout:        time.Duration(cfg.TaskLeaseTimeoutMs) * time.Millisecond,
+
+		timings: models.OperationTimings{
+			AdditionMs:       cfg.TimeAdditionMs,
+			SubtractionMs:    cfg.TimeSubtractionMs,
+			MultiplicationMs: cfg.TimeMultiplicationsMs,
+			DivisionMs:       cfg.TimeDivisionsMs,
+		},
+		timingsFile:       cfg.TimingsFile,
+		tasksQueue:        newScheduler(cfg.UserWeights, cfg.MaxLeasedPerExpr, aging),
+		allTasks:          make(map[models.ID]*models.Task),
+		taskArgs:          make(map[models.ID]*models.Argument),
+		allExpressions:    make(map[models.ID]*models.Expression),
+		expressionTasks:   make(map[models.ID][]models.ID),
+		pendingSubtrees:   make(map[string]models.ID),
+		webhookDeliveries: make(map[models.ID][]*models.WebhookDelivery),
+		results:           cache.NewLRU[string, float64](cfg.ResultCacheSize, cacheTTL),
+		agents:            make(map[string]agentActivity),
+		leases:            make(map[models.ID]*models.Task),
+		tracer:            tracing.NewTracer("orchestrator", exporter),
+		spans:             make(map[models.ID]*tracing.ActiveSpan),
+	}
+	s.metrics = newServiceMetrics(s)
+	return s
+}
+
+func (s *APIService) enqueueTask(task *models.Task) {
+	s.tasksQueue.Push(task)
+}
+
+// resultKey identifies a ready task by its operation and argument values;
+// arguments of commutative operations are ordered so that 2+3 and 3+2 match.
+func resultKey(task *models.Task) string {
+	a, b := task.Arg1.Value, task.Arg2.Value
+	if (task.Operation == "+" || task.Operation == "*") && b < a {
+		a, b = b, a
+	}
+	return task.Operation + "|" + strconv.FormatFloat(a, 'g', -1, 64) + "|" + strconv.FormatFloat(b, 'g', -1, 64)
+}
+
+// dispatchTask resolves a ready task from the result cache or enqueues it for agents.
+func (s *APIService) dispatchTask(ctx context.Context, task *models.Task) {
+	task.EnqueuedAt = time.Now()
+	if result, hit := s.results.Get(resultKey(task)); hit {
+		slog.DebugContext(ctx, "task resolved from cache", "expression_id", task.ExpressionID, "task_id", task.ID)
+		task.CacheHit = true
+		s.metrics.tasksCached.Inc(task.Operation)
+		s.completeTask(ctx, task, result)
+		return
+	}
+	s.enqueueTask(task)
+}
+
+func (s *APIService) finishExpression(ctx context.Context, expression *models.Expression, result float64) {
+	expression.Result = result
+	expression.Status = models.StatusConfirmed
+	if span, exists := s.spans[expression.ID]; exists {
+		span.SetAttribute("result", strconv.FormatFloat(result, 'g', -1, 64))
+	}
+	s.closeExpression(ctx, expression)
+	slog.InfoContext(ctx, "expression finished", "expression_id", expression.ID, "result", result,
+		"duration_ms", expression.FinishedAt.Sub(expression.CreatedAt).Milliseconds())
+}
+
+// failExpression ends an expression whose computation failed with code.
+func (s *APIService) failExpression(ctx context.Context, expression *models.Expression, code string) {
+	expression.Status = models.StatusFailed
+	expression.Error = code
+	if span, exists := s.spans[expression.ID]; exists {
+		span.SetAttribute("error", code)
+	}
+	s.closeExpression(ctx, expression)
+	slog.WarnContext(ctx, "expression failed", "expression_id", expression.ID, "error", code,
+		"duration_ms", expression.FinishedAt.Sub(expression.CreatedAt).Milliseconds())
+}
+
+func (s *APIService) closeExpression(ctx context.Context, expression *models.Expression) {
+	finishedAt := time.Now()
+	expression.FinishedAt = &finishedAt
+	s.metrics.expressionDuration.Observe(finishedAt.Sub(expression.CreatedAt).Seconds(), expression.Priority)
+	if span, exists := s.spans[expression.ID]; exists {
+		span.End()
+		delete(s.spans, expression.ID)
+	}
+	s.tasksQueue.Forget(expression.ID)
+	s.notifyCompletion(ctx, expression)
+}
+
+// releaseTask marks a task as done and frees its lease and backlog slot.
+func (s *APIService) releaseTask(task *models.Task) {
+	task.Confirmed = true
+	task.CompletedAt = time.Now()
+	s.backlog--
+	s.tasksQueue.Release(task)
+	task.Leased = false
+	delete(s.leases, task.ID)
+	if s.pendingSubtrees[task.Hash] == task.ID {
+		delete(s.pendingSubtrees, task.Hash)
+	}
+	if span, exists := s.spans[task.ID]; exists {
+		span.SetAttribute("agent_id", task.AgentID)
+		span.SetAttribute("cache_hit", strconv.FormatBool(task.CacheHit))
+		if task.Error != "" {
+			span.SetAttribute("error", task.Error)
+		}
+		span.End()
+		delete(s.spans, task.ID)
+	}
+}
+
+func (s *APIService) completeTask(ctx context.Context, task *models.Task, result float64) {
+	task.Result = result
+	s.releaseTask(task)
+	s.results.Put(resultKey(task), result)
+
+	for _, expressionID := range task.ExpressionIDs {
+		expression, expressionExists := s.allExpressions[expressionID]
+		if expressionExists {
+			s.finishExpression(ctx, expression, result)
+		}
+	}
+	for _, argID := range task.ParentArgIDs {
+		// the argument is gone when its expression failed and was removed
+		// while this subtree was still computing
+		arg, exists := s.taskArgs[argID]
+		if !exists {
+			continue
+		}
+		arg.Value = result
+		arg.Ready = true
+
+		// parent is nil while addTasks is still building it; it is
+		// dispatched there once both arguments are known. A parent that
+		// already failed through its other argument is never dispatched.
+		parent := s.allTasks[arg.ParentTaskID]
+		if parent != nil && !parent.Confirmed && parent.IsReady() {
+			s.dispatchTask(ctx, parent)
+		}
 	}
+	s.dropOrphan(task)
 }
 
-func (s *APIService) addTasks(node *calc.Node, parentArgID uint32, expressionID uint32) {
+// addTasks creates the tasks for node and its subtrees. pathAbove is the
+// operation time between node and the root of the expression.
+func (s *APIService) addTasks(ctx context.Context, node *calc.Node, hashes map[*calc.Node]string, parentArgID models.ID, expressionID models.ID, pathAbove int) {
 	left, right := node.Left, node.Right
 	if left == nil && right == nil {
 		value, _ := strconv.ParseFloat(node.Value, 64)
-		taskArgs[parentArgID].Value = value
-		taskArgs[parentArgID].Ready = true
+		s.taskArgs[parentArgID].Value = value
+		s.taskArgs[parentArgID].Ready = true
+		return
+	}
+
+	hash := hashes[node]
+	operationTime := s.timings.For(node.Value)
+	if sharedTaskID, exists := s.pendingSubtrees[hash]; exists {
+		shared := s.allTasks[sharedTaskID]
+		shared.AddDependent(parentArgID, expressionID)
+		if pathAbove+operationTime > shared.CriticalPath {
+			shared.CriticalPath = pathAbove + operationTime
+			s.tasksQueue.Update(shared)
+		}
+		s.shareSubtree(node, hashes, expressionID)
 		return
 	}
-	taskID := uuid.New().ID()
-	arg1ID := uuid.New().ID()
-	arg2ID := uuid.New().ID()
 
-	taskArgs[arg1ID] = &models.Argument{ParentTaskID: taskID}
-	taskArgs[arg2ID] = &models.Argument{ParentTaskID: taskID}
+	taskID := models.NewID()
+	arg1ID := models.NewID()
+	arg2ID := models.NewID()
+
+	s.taskArgs[arg1ID] = &models.Argument{ParentTaskID: taskID}
+	s.taskArgs[arg2ID] = &models.Argument{ParentTaskID: taskID}
 
-	s.addTasks(left, arg1ID, 0)
-	s.addTasks(right, arg2ID, 0)
+	s.addTasks(ctx, left, hashes, arg1ID, expressionID, pathAbove+operationTime)
+	s.addTasks(ctx, right, hashes, arg2ID, expressionID, pathAbove+operationTime)
 
 	task := &models.Task{
 		ID:            taskID,
-		ParentArgID:   parentArgID,
-		Arg1:          taskArgs[arg1ID],
-		Arg2:          taskArgs[arg2ID],
 		ExpressionID:  expressionID,
+		User:          s.allExpressions[expressionID].User,
+		Hash:          hash,
+		Arg1ID:        arg1ID,
+		Arg2ID:        arg2ID,
+		Arg1:          s.taskArgs[arg1ID],
+		Arg2:          s.taskArgs[arg2ID],
 		Operation:     node.Value,
-		OperationTime: getOperationTime(s, node.Value),
+		OperationTime: operationTime,
+		CriticalPath:  pathAbove + operationTime,
 	}
+	task.AddDependent(parentArgID, expressionID)
+	s.allTasks[taskID] = task
+	span := s.tracer.Start("task "+task.Operation, s.spans[expressionID].Context())
+	span.SetAttribute("task_id", string(taskID))
+	s.spans[taskID] = span
+	s.expressionTasks[expressionID] = append(s.expressionTasks[expressionID], taskID)
+	s.backlog++
+	s.pendingSubtrees[hash] = taskID
 	if task.IsReady() {
-		tasksQueue <- &models.TaskResponse{
-			ID:            strconv.Itoa(int(task.ID)),
-			Arg1:          task.Arg1.Value,
-			Arg2:          task.Arg2.Value,
-			Operation:     task.Operation,
-			OperationTime: task.OperationTime,
-		}
+		s.dispatchTask(ctx, task)
 	}
-	allTasks[taskID] = task
 }
 
-func (s *APIService) CreateTasks(expression string) (uint32, error) {
-	expressionTree, err := calc.ToTree(expression)
+// shareSubtree records the pending tasks of a shared subtree for the trace
+// of expressionID. Subtrees that are no longer pending were computed before
+// the expression was submitted.
+func (s *APIService) shareSubtree(node *calc.Node, hashes map[*calc.Node]string, expressionID models.ID) {
+	if node.Left == nil && node.Right == nil {
+		return
+	}
+	taskID, exists := s.pendingSubtrees[hashes[node]]
+	if !exists {
+		return
+	}
+	task := s.allTasks[taskID]
+	if !task.TracedBy(expressionID) {
+		task.SharedWith = append(task.SharedWith, expressionID)
+		s.expressionTasks[expressionID] = append(s.expressionTasks[expressionID], taskID)
+	}
+	s.shareSubtree(node.Left, hashes, expressionID)
+	s.shareSubtree(node.Right, hashes, expressionID)
+}
+
+func countOperations(node *calc.Node) int {
+	if node.Left == nil && node.Right == nil {
+		return 0
+	}
+	return 1 + countOperations(node.Left) + countOperations(node.Right)
+}
+
+func (s *APIService) CreateTasks(ctx context.Context, request *models.ExpressionRequest) (models.ID, error) {
+	expressionTree, err := calc.ToTree(request.Expression)
+	if err != nil {
+		return "", err
+	}
+	err = s.validateCallbackURL(request.CallbackURL)
 	if err != nil {
-		return 0, err
+		return "", err
+	}
+	priority := request.Priority
+	if priority == "" {
+		priority = models.PriorityNormal
+	}
+	level, valid := models.PriorityLevel(priority)
+	if !valid {
+		return "", ErrPriorityInvalid
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return "", ErrShuttingDown
+	}
+	if s.MaxBacklog > 0 && s.backlog+countOperations(&expressionTree) > s.MaxBacklog {
+		return "", ErrBacklogFull
 	}
 
-	expressionID := uuid.New().ID()
-	allExpressions[expressionID] = &models.Expression{ID: expressionID, Status: "pending"}
+	expressionID := models.NewID()
+	expression := &models.Expression{
+		ID:          expressionID,
+		User:        request.User,
+		Status:      models.StatusPending,
+		Priority:    priority,
+		CallbackURL: request.CallbackURL,
+		CreatedAt:   time.Now(),
+	}
+	s.allExpressions[expressionID] = expression
+	parent, _ := tracing.Parse(request.TraceParent)
+	span := s.tracer.Start("expression", parent)
+	span.SetAttribute("expression_id", string(expressionID))
+	expression.TraceID = span.Context().TraceID
+	s.spans[expressionID] = span
 
-	s.addTasks(&expressionTree, 0, expressionID)
+	if request.Optimize || s.OptimizeExpressions {
+		expressionTree = calc.Optimize(expressionTree)
+		expression.Optimized = expressionTree.Infix()
+	}
+	if expressionTree.Left == nil && expressionTree.Right == nil {
+		result, _ := strconv.ParseFloat(expressionTree.Value, 64)
+		s.finishExpression(ctx, expression, result)
+		return expressionID, nil
+	}
+	s.tasksQueue.SetPriority(expressionID, level)
+	s.addTasks(ctx, &expressionTree, expressionTree.Hashes(), "", expressionID, 0)
+	slog.InfoContext(ctx, "expression created", "expression_id", expressionID, "user", request.User,
+		"priority", priority, "tasks", len(s.expressionTasks[expressionID]))
 
 	return expressionID, nil
 }
 
-func (s *APIService) GetTask() *models.TaskResponse {
-	select {
-	case task := <-tasksQueue:
-		return task
-	default:
+func (s *APIService) GetTask(ctx context.Context, agentID string) *models.TaskResponse {
+	tasks := s.GetTasks(ctx, agentID, 1, 1)
+	if len(tasks) == 0 {
 		return nil
 	}
+	return tasks[0]
+}
+
+// GetTasks leases up to max ready tasks to agentID, in scheduling order.
+// workers is the number of agent workers the poll is made for.
+func (s *APIService) GetTasks(ctx context.Context, agentID string, workers int, max int) []*models.TaskResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.touchAgent(agentID, workers, now)
+	s.expireLeases(ctx, now)
+	var tasks []*models.TaskResponse
+	for len(tasks) < max {
+		task := s.tasksQueue.Pop()
+		if task == nil {
+			break
+		}
+		tasks = append(tasks, s.leaseTask(ctx, task, agentID, now))
+	}
+	return tasks
+}
+
+func (s *APIService) leaseTask(ctx context.Context, task *models.Task, agentID string, now time.Time) *models.TaskResponse {
+	task.Leased = true
+	task.AgentID = agentID
+	task.LeasedAt = &now
+	s.leases[task.ID] = task
+	s.metrics.tasksDispatched.Inc(task.Operation)
+	slog.DebugContext(ctx, "task leased", "expression_id", task.ExpressionID, "task_id", task.ID, "agent_id", agentID)
+	response := &models.TaskResponse{
+		ID:            task.ID,
+		Arg1:          task.Arg1.Value,
+		Arg2:          task.Arg2.Value,
+		Operation:     task.Operation,
+		OperationTime: task.OperationTime,
+	}
+	if span, exists := s.spans[task.ID]; exists {
+		response.TraceParent = span.Context().String()
+	}
+	return response
 }
 
-func (s *APIService) GetExpressionByID(expressionID uint32) *models.Expression {
-	expression, exists := allExpressions[expressionID]
+// GetExpressionByID returns a copy of the expression, which callers may read
+// without holding the lock.
+func (s *APIService) GetExpressionByID(expressionID models.ID) *models.Expression {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expression, exists := s.allExpressions[expressionID]
 	if exists {
-		return expression
+		snapshot := *expression
+		return &snapshot
 	}
 	return nil
 }
 
+func (s *APIService) SetExpressionPriority(expressionID models.ID, priority string) (*models.Expression, error) {
+	level, valid := models.PriorityLevel(priority)
+	if !valid {
+		return nil, ErrPriorityInvalid
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expression, exists := s.allExpressions[expressionID]
+	if !exists {
+		return nil, ErrIDExpressionNotExists
+	}
+	expression.Priority = priority
+	if !expression.IsFinished() {
+		s.tasksQueue.SetPriority(expressionID, level)
+	}
+	snapshot := *expression
+	return &snapshot, nil
+}
+
+// GetAllExpressions returns copies of the expressions.
 func (s *APIService) GetAllExpressions() []*models.Expression {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	expressions := []*models.Expression{}
-	for _, expression := range allExpressions {
-		expressions = append(expressions, expression)
+	for _, expression := range s.allExpressions {
+		snapshot := *expression
+		expressions = append(expressions, &snapshot)
 	}
 	return expressions
 }
 
-func (s *APIService) ConfirmTask(taskID uint32, result float64) error {
-	task, taskExists := allTasks[taskID]
-	if taskExists {
-		expression, expressionExists := allExpressions[task.ExpressionID]
-		if expressionExists {
-			expression.Result = result
-			expression.Status = "confirmed"
-		} else {
-			taskArgs[task.ParentArgID].Value = result
-			taskArgs[task.ParentArgID].Ready = true
-
-			task = allTasks[taskArgs[task.ParentArgID].ParentTaskID]
-			if task.IsReady() {
-				tasksQueue <- &models.TaskResponse{
-					ID:            strconv.Itoa(int(task.ID)),
-					Arg1:          task.Arg1.Value,
-					Arg2:          task.Arg2.Value,
-					Operation:     task.Operation,
-					OperationTime: task.OperationTime,
-				}
-			}
+func (s *APIService) ConfirmTask(ctx context.Context, taskID models.ID, result float64) error {
+	return s.reportResult(ctx, models.TaskResult{TaskID: taskID, Result: result})
+}
+
+// FailTask records that the computation of a task failed with code. The
+// failure propagates to every task and expression that depends on it, so
+// their backlog slots are released and the expressions finish as failed.
+func (s *APIService) FailTask(ctx context.Context, taskID models.ID, code string) error {
+	return s.reportResult(ctx, models.TaskResult{TaskID: taskID, Error: code})
+}
+
+// reportResult confirms a task result or records its failure. The worker
+// named in the result replaces the lessee in the trace, since a batch of
+// tasks is leased by the fetcher of an agent rather than by its workers.
+func (s *APIService) reportResult(ctx context.Context, result models.TaskResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, taskExists := s.allTasks[result.TaskID]
+	if !taskExists {
+		s.metrics.resultsRejected.Inc()
+		slog.WarnContext(ctx, "result for unknown task", "task_id", result.TaskID, "error", result.Error)
+		return ErrIDTaskNotExists
+	}
+	if task.Confirmed {
+		slog.DebugContext(ctx, "duplicate task result", "expression_id", task.ExpressionID, "task_id", task.ID,
+			"agent_id", task.AgentID, "error", result.Error)
+		return nil
+	}
+	if result.AgentID != "" {
+		task.AgentID = result.AgentID
+	}
+	if result.Error != "" {
+		slog.DebugContext(ctx, "task failed", "expression_id", task.ExpressionID, "task_id", task.ID,
+			"agent_id", task.AgentID, "error", result.Error)
+		s.metrics.tasksFailed.Inc(task.Operation)
+		s.failTask(ctx, task, result.Error)
+		return nil
+	}
+	slog.DebugContext(ctx, "task confirmed", "expression_id", task.ExpressionID, "task_id", task.ID, "agent_id", task.AgentID)
+	s.metrics.tasksConfirmed.Inc(task.Operation)
+	s.completeTask(ctx, task, result.Result)
+	return nil
+}
+
+func (s *APIService) failTask(ctx context.Context, task *models.Task, code string) {
+	task.Error = code
+	s.releaseTask(task)
+
+	for _, expressionID := range task.ExpressionIDs {
+		expression, expressionExists := s.allExpressions[expressionID]
+		if expressionExists && !expression.IsFinished() {
+			s.failExpression(ctx, expression, code)
+		}
+	}
+	for _, argID := range task.ParentArgIDs {
+		arg, exists := s.taskArgs[argID]
+		if !exists {
+			continue
+		}
+		parent := s.allTasks[arg.ParentTaskID]
+		if parent != nil && !parent.Confirmed {
+			s.failTask(ctx, parent, code)
+		}
+	}
+	s.dropOrphan(task)
+}
+
+// GetExpressionTrace lists the tasks of a finished expression in the order
+// they were enqueued, including tasks shared with an earlier expression
+// that were still pending when it was submitted.
+func (s *APIService) GetExpressionTrace(expressionID models.ID) ([]*models.TaskTrace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expression, exists := s.allExpressions[expressionID]
+	if !exists {
+		return nil, ErrIDExpressionNotExists
+	}
+	if !expression.IsFinished() {
+		return nil, ErrExpressionNotFinished
+	}
+
+	trace := []*models.TaskTrace{}
+	for _, taskID := range s.expressionTasks[expressionID] {
+		task, exists := s.allTasks[taskID]
+		if !exists || !task.Confirmed {
+			continue
+		}
+		entry := &models.TaskTrace{
+			ID:          task.ID,
+			Operation:   task.Operation,
+			Arg1:        task.Arg1.Value,
+			Arg2:        task.Arg2.Value,
+			Result:      task.Result,
+			Error:       task.Error,
+			AgentID:     task.AgentID,
+			CacheHit:    task.CacheHit,
+			EnqueuedAt:  task.EnqueuedAt,
+			LeasedAt:    task.LeasedAt,
+			CompletedAt: task.CompletedAt,
+		}
+		if task.LeasedAt != nil {
+			entry.WaitMs = task.LeasedAt.Sub(task.EnqueuedAt).Milliseconds()
 		}
+		trace = append(trace, entry)
+	}
+	sort.SliceStable(trace, func(i, j int) bool {
+		return trace[i].EnqueuedAt.Before(trace[j].EnqueuedAt)
+	})
+	return trace, nil
+}
+
+// ReturnTask puts a leased task back into the queue, e.g. when its agent
+// shuts down before finishing it. Unleased tasks are left as they are.
+func (s *APIService) ReturnTask(ctx context.Context, taskID models.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, taskExists := s.allTasks[taskID]
+	if !taskExists {
+		return ErrIDTaskNotExists
+	}
+	if !task.Leased || task.Confirmed {
 		return nil
 	}
-	return ErrIDTaskNotExists
+	slog.InfoContext(ctx, "task returned", "expression_id", task.ExpressionID, "task_id", task.ID, "agent_id", task.AgentID)
+	s.requeueTask(ctx, task)
+	return nil
+}
+
+// requeueTask ends the lease of a task and queues it for another agent.
+func (s *APIService) requeueTask(ctx context.Context, task *models.Task) {
+	s.tasksQueue.Release(task)
+	task.Leased = false
+	task.AgentID = ""
+	task.LeasedAt = nil
+	delete(s.leases, task.ID)
+	s.enqueueTask(task)
+}
+
+// expireLeases queues again the tasks whose agents did not report back
+// within their operation time plus LeaseTimeout, e.g. because the agent
+// was killed or dropped the result. A late result is still accepted.
+func (s *APIService) expireLeases(ctx context.Context, now time.Time) {
+	if s.LeaseTimeout <= 0 {
+		return
+	}
+	for _, task := range s.leases {
+		deadline := task.LeasedAt.Add(time.Duration(task.OperationTime)*time.Millisecond + s.LeaseTimeout)
+		if now.Before(deadline) {
+			continue
+		}
+		slog.WarnContext(ctx, "task lease expired", "expression_id", task.ExpressionID, "task_id", task.ID,
+			"agent_id", task.AgentID)
+		s.metrics.leasesExpired.Inc(task.Operation)
+		s.requeueTask(ctx, task)
+	}
+}
+
+func (s *APIService) GetCacheStats() cache.Stats {
+	return s.results.Stats()
 }
 
 // 5 | 38
@@ -0,0 +1,161 @@
+package orchestrator
+
+import (
+	"calc-website/config"
+	"calc-website/internal/models"
+	"calc-website/pkg/calc"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Run with -race: expressions handed to handlers must not be written by
+// finishing tasks while they are encoded.
+func TestExpressionsAreCopied(t *testing.T) {
+	s := NewAPIService(&config.Config{})
+	id, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: "1 + 2 + 3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for task := s.GetTask(context.Background(), "test"); task != nil; task = s.GetTask(context.Background(), "test") {
+			result, _ := calc.Compute(task.Arg1, task.Arg2, task.Operation)
+			_ = s.ConfirmTask(context.Background(), task.ID, result)
+		}
+	}()
+	for finished := false; !finished; {
+		expression := s.GetExpressionByID(id)
+		if _, err := json.Marshal(expression); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := json.Marshal(s.GetAllExpressions()); err != nil {
+			t.Fatal(err)
+		}
+		finished = expression.IsFinished()
+	}
+	<-done
+
+	expression := s.GetExpressionByID(id)
+	expression.Result = 0
+	if s.GetExpressionByID(id).Result != 6 {
+		t.Error("changing a returned expression changed the stored one")
+	}
+}
+
+func TestFailTask(t *testing.T) {
+	s := NewAPIService(&config.Config{})
+	var ids []models.ID
+	// the second expression shares the pending 3 / (2 - 2) subtree of the first
+	for _, expression := range []string{"(1 + 2) * (3 / (2 - 2))", "3 / (2 - 2) - 1"} {
+		id, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: expression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	for task := s.GetTask(context.Background(), "test"); task != nil; task = s.GetTask(context.Background(), "test") {
+		result, err := calc.Compute(task.Arg1, task.Arg2, task.Operation)
+		if err != nil {
+			err = s.FailTask(context.Background(), task.ID, models.CodeDivisionByZero)
+		} else {
+			err = s.ConfirmTask(context.Background(), task.ID, result)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range ids {
+		expression := s.GetExpressionByID(id)
+		if expression.Status != models.StatusFailed || expression.Error != models.CodeDivisionByZero {
+			t.Errorf("expression %s: status %q, error %q, expected it to fail with %s",
+				id, expression.Status, expression.Error, models.CodeDivisionByZero)
+		}
+		if expression.FinishedAt == nil {
+			t.Errorf("expression %s has no finish time", id)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.backlog != 0 || s.tasksQueue.Leased() != 0 || s.tasksQueue.Len() != 0 {
+		t.Errorf("backlog %d, leased %d, queued %d, expected the failed tasks to be released",
+			s.backlog, s.tasksQueue.Leased(), s.tasksQueue.Len())
+	}
+}
+
+func TestResultAfterFailedExpressionIsDeleted(t *testing.T) {
+	s := NewAPIService(&config.Config{})
+	id, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: "(1 + 2) * (3 / (2 - 2))"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum *models.TaskResponse
+	for _, task := range s.GetTasks(context.Background(), "test", 1, 2) {
+		if task.Operation == "+" {
+			sum = task
+		} else if err := s.ConfirmTask(context.Background(), task.ID, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	division := s.GetTask(context.Background(), "test")
+	if sum == nil || division == nil {
+		t.Fatal("expected 1 + 2 and the division to be leased")
+	}
+	if err := s.FailTask(context.Background(), division.ID, models.CodeDivisionByZero); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteExpression(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ConfirmTask(context.Background(), sum.ID, 3); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.backlog != 0 || s.tasksQueue.Leased() != 0 {
+		t.Errorf("backlog %d, leased %d, expected the late result to release its task",
+			s.backlog, s.tasksQueue.Leased())
+	}
+	if len(s.allTasks) != 0 || len(s.taskArgs) != 0 {
+		t.Errorf("%d tasks and %d arguments left, expected the late task to be forgotten",
+			len(s.allTasks), len(s.taskArgs))
+	}
+}
+
+func TestExpiredLeaseIsQueuedAgain(t *testing.T) {
+	s := NewAPIService(&config.Config{TaskLeaseTimeoutMs: 50, MaxLeasedPerExpr: 1})
+	id, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: "1 + 2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost := s.GetTask(context.Background(), "dead-agent")
+	if lost == nil {
+		t.Fatal("no task leased")
+	}
+	if task := s.GetTask(context.Background(), "test"); task != nil {
+		t.Fatalf("task %s leased twice before its lease expired", task.ID)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	task := s.GetTask(context.Background(), "test")
+	if task == nil || task.ID != lost.ID {
+		t.Fatalf("GetTask() = %+v, expected the expired task %s", task, lost.ID)
+	}
+	if err := s.ConfirmTask(context.Background(), task.ID, 3); err != nil {
+		t.Fatal(err)
+	}
+	if expression := s.GetExpressionByID(id); expression.Status != models.StatusConfirmed {
+		t.Errorf("expression status %q, expected %q", expression.Status, models.StatusConfirmed)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tasksQueue.Leased() != 0 || len(s.leases) != 0 {
+		t.Errorf("%d tasks leased, expected none", s.tasksQueue.Leased())
+	}
+}
@@ -0,0 +1,50 @@
+package orchestrator
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const drainPollInterval = 50 * time.Millisecond
+
+// Draining reports whether the service is shutting down.
+func (s *APIService) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// QueueDepth returns the number of tasks waiting for an agent.
+func (s *APIService) QueueDepth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tasksQueue.Len()
+}
+
+// Drain stops accepting expressions and handing out tasks, then waits until
+// agents have confirmed or returned every leased task, or its lease expired,
+// or ctx is done. It returns the number of tasks still leased.
+func (s *APIService) Drain(ctx context.Context) int {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		s.expireLeases(ctx, time.Now())
+		leased := s.tasksQueue.Leased()
+		s.mu.Unlock()
+		if leased == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			slog.WarnContext(ctx, "drain timed out with leased tasks", "leased", leased)
+			return leased
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package orchestrator
+
+import (
+	"calc-website/config"
+	"calc-website/internal/models"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveAndLoadState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s := NewAPIService(&config.Config{})
+	finishedID, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: "1 + 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	computeAll(t, s)
+	pendingID, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: "2 + 3 * 4", Priority: models.PriorityHigh})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leased := s.GetTask(context.Background(), "test")
+	if err := s.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewAPIService(&config.Config{})
+	if err := restored.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if expression := restored.GetExpressionByID(finishedID); expression == nil || expression.Result != 2 {
+		t.Errorf("finished expression restored as %+v, expected result 2", expression)
+	}
+	// the lease is lost with the agent, so the task is queued again
+	if task := restored.GetTask(context.Background(), "test"); task == nil || task.ID != leased.ID {
+		t.Fatalf("GetTask() after restore = %+v, expected the leased task %s", task, leased.ID)
+	} else if err := restored.ConfirmTask(context.Background(), task.ID, 12); err != nil {
+		t.Fatal(err)
+	}
+	computeAll(t, restored)
+	if expression := restored.GetExpressionByID(pendingID); expression == nil || expression.Result != 14 {
+		t.Errorf("pending expression finished as %+v, expected result 14", expression)
+	}
+
+	if err := NewAPIService(&config.Config{}).LoadState(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("LoadState() of a missing file = %v, expected nil", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := NewAPIService(&config.Config{})
+	if _, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: "1 + 2 + 3"}); err != nil {
+		t.Fatal(err)
+	}
+	task := s.GetTask(context.Background(), "test")
+
+	drained := make(chan int)
+	go func() {
+		drained <- s.Drain(context.Background())
+	}()
+	time.Sleep(2 * drainPollInterval)
+	if _, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: "1 + 2"}); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("CreateTasks() while draining = %v, expected ErrShuttingDown", err)
+	}
+	if err := s.ReturnTask(context.Background(), task.ID); err != nil {
+		t.Fatal(err)
+	}
+	if leased := <-drained; leased != 0 {
+		t.Errorf("Drain() = %d, expected 0 leased tasks", leased)
+	}
+	if s.tasksQueue.Len() != 1 {
+		t.Errorf("%d tasks queued, expected the returned task", s.tasksQueue.Len())
+	}
+
+	s.GetTask(context.Background(), "test")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*drainPollInterval)
+	defer cancel()
+	if leased := s.Drain(ctx); leased != 1 {
+		t.Errorf("Drain() = %d after timeout, expected 1 leased task", leased)
+	}
+}
+
+func TestDrainEndsWhenLeasesExpire(t *testing.T) {
+	s := NewAPIService(&config.Config{TaskLeaseTimeoutMs: 50})
+	if _, err := s.CreateTasks(context.Background(), &models.ExpressionRequest{Expression: "1 + 2"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetTask(context.Background(), "dead-agent") == nil {
+		t.Fatal("no task leased")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if leased := s.Drain(ctx); leased != 0 {
+		t.Errorf("Drain() = %d, expected the expired lease to be released", leased)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Drain() took %v, expected it to end after the lease timeout", elapsed)
+	}
+}
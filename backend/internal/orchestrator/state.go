@@ -0,0 +1,121 @@
+package orchestrator
+
+import (
+	"calc-website/internal/models"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// snapshot is the persisted state of the service. Leases are not kept:
+// restored tasks that were leased are queued again.
+type snapshot struct {
+	Expressions       []*models.Expression                    `json:"expressions"`
+	Tasks             []*models.Task                          `json:"tasks"`
+	Arguments         map[models.ID]*models.Argument          `json:"arguments"`
+	ExpressionTasks   map[models.ID][]models.ID               `json:"expression_tasks"`
+	WebhookDeliveries map[models.ID][]*models.WebhookDelivery `json:"webhook_deliveries,omitempty"`
+}
+
+// SaveState writes the expressions and tasks to path. The file is replaced
+// atomically so a crash while saving keeps the previous state.
+func (s *APIService) SaveState(path string) error {
+	s.mu.Lock()
+	state := snapshot{
+		Expressions:       make([]*models.Expression, 0, len(s.allExpressions)),
+		Tasks:             make([]*models.Task, 0, len(s.allTasks)),
+		Arguments:         s.taskArgs,
+		ExpressionTasks:   s.expressionTasks,
+		WebhookDeliveries: s.webhookDeliveries,
+	}
+	for _, expression := range s.allExpressions {
+		state.Expressions = append(state.Expressions, expression)
+	}
+	for _, task := range s.allTasks {
+		state.Tasks = append(state.Tasks, task)
+	}
+	data, err := json.Marshal(state)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces path with data through a temporary file in the
+// same directory, so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadState restores the state saved by SaveState and queues the ready
+// tasks again. A missing file is not an error.
+func (s *APIService) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state snapshot
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, expression := range state.Expressions {
+		s.allExpressions[expression.ID] = expression
+		if !expression.IsFinished() {
+			level, _ := models.PriorityLevel(expression.Priority)
+			s.tasksQueue.SetPriority(expression.ID, level)
+		}
+	}
+	for argID, arg := range state.Arguments {
+		s.taskArgs[argID] = arg
+	}
+	for expressionID, taskIDs := range state.ExpressionTasks {
+		s.expressionTasks[expressionID] = taskIDs
+	}
+	for expressionID, deliveries := range state.WebhookDeliveries {
+		s.webhookDeliveries[expressionID] = deliveries
+	}
+
+	queued := 0
+	for _, task := range state.Tasks {
+		task.Arg1 = s.taskArgs[task.Arg1ID]
+		task.Arg2 = s.taskArgs[task.Arg2ID]
+		s.allTasks[task.ID] = task
+		if task.Confirmed {
+			continue
+		}
+		s.backlog++
+		s.pendingSubtrees[task.Hash] = task.ID
+		task.Leased = false
+		task.AgentID = ""
+		task.LeasedAt = nil
+		if task.IsReady() {
+			s.enqueueTask(task)
+			queued++
+		}
+	}
+	slog.Info("state restored", "path", path, "expressions", len(state.Expressions),
+		"tasks", len(state.Tasks), "queued", queued)
+	return nil
+}
@@ -0,0 +1,71 @@
+package orchestrator
+
+import (
+	"calc-website/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+)
+
+var ErrTimingInvalid = errors.New("operation time must not be negative")
+
+// OperationTimings returns the operation times given to new tasks.
+func (s *APIService) OperationTimings() models.OperationTimings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.timings
+}
+
+// UpdateOperationTimings changes the operation times of tasks created from
+// now on and saves them to the timings file. Queued and leased tasks keep
+// the time they were created with.
+func (s *APIService) UpdateOperationTimings(ctx context.Context, update models.TimingsUpdate) (models.OperationTimings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	timings := update.Apply(s.timings)
+	if !timings.IsValid() {
+		return s.timings, ErrTimingInvalid
+	}
+	if s.timingsFile != "" {
+		data, err := json.Marshal(timings)
+		if err != nil {
+			return s.timings, err
+		}
+		if err := writeFileAtomic(s.timingsFile, data); err != nil {
+			return s.timings, err
+		}
+	}
+	slog.InfoContext(ctx, "operation timings changed", "from", s.timings, "to", timings)
+	s.timings = timings
+	return timings, nil
+}
+
+// LoadTimings replaces the configured operation times with the ones saved
+// by UpdateOperationTimings. A missing file is not an error.
+func (s *APIService) LoadTimings() error {
+	if s.timingsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.timingsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	timings := s.OperationTimings()
+	if err := json.Unmarshal(data, &timings); err != nil {
+		return err
+	}
+	if !timings.IsValid() {
+		return ErrTimingInvalid
+	}
+	s.mu.Lock()
+	s.timings = timings
+	s.mu.Unlock()
+	slog.Info("operation timings restored", "path", s.timingsFile, "timings", timings)
+	return nil
+}
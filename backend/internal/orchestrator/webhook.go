@@ -0,0 +1,155 @@
+package orchestrator
+
+import (
+	"bytes"
+	"calc-website/internal/models"
+	"calc-website/pkg/utils"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const SignatureHeader = "X-Calc-Signature"
+
+var (
+	ErrCallbackURLInvalid = errors.New("callback url is invalid")
+	// ErrCallbacksDisabled rejects callbacks that could not be signed
+	// because no webhook secret is configured
+	ErrCallbacksDisabled = errors.New("callbacks are disabled: no webhook secret is configured")
+)
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+func (s *APIService) validateCallbackURL(callbackURL string) error {
+	if callbackURL == "" {
+		return nil
+	}
+	if s.WebhookSecret == "" {
+		return ErrCallbacksDisabled
+	}
+	parsed, err := url.Parse(callbackURL)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return ErrCallbackURLInvalid
+	}
+	return nil
+}
+
+// SignPayload returns the value of SignatureHeader for a webhook body.
+func SignPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyCompletion must be called with s.mu held; the payload is snapshotted
+// before the delivery goroutine starts.
+func (s *APIService) notifyCompletion(ctx context.Context, expression *models.Expression) {
+	if expression.CallbackURL == "" {
+		return
+	}
+	payload, err := json.Marshal(expression)
+	if err != nil {
+		slog.ErrorContext(ctx, "marshal webhook payload error", "expression_id", expression.ID, "error", err)
+		return
+	}
+	go s.deliverWebhook(context.WithoutCancel(ctx), expression.ID, expression.CallbackURL, payload)
+}
+
+// deliverWebhook posts the payload until it is accepted or the attempts run
+// out. It stops once the expression is purged or deleted, so the delivery
+// log of a removed expression is not created again.
+func (s *APIService) deliverWebhook(ctx context.Context, expressionID models.ID, callbackURL string, payload []byte) {
+	backoff := time.Duration(s.WebhookBackoffMs) * time.Millisecond
+	for attempt := 1; attempt <= s.WebhookMaxAttempts; attempt++ {
+		if attempt > 1 && !s.expressionExists(expressionID) {
+			slog.DebugContext(ctx, "webhook retries stopped, expression removed", "expression_id", expressionID)
+			return
+		}
+		delivery := s.postWebhook(callbackURL, payload, attempt)
+		if !s.recordDelivery(expressionID, delivery) {
+			slog.DebugContext(ctx, "webhook delivery not recorded, expression removed", "expression_id", expressionID)
+			return
+		}
+
+		if delivery.Success {
+			return
+		}
+		slog.WarnContext(ctx, "webhook delivery failed",
+			"expression_id", expressionID, "attempt", attempt, "error", delivery.Error)
+		if attempt < s.WebhookMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (s *APIService) expressionExists(expressionID models.ID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.allExpressions[expressionID]
+	return exists
+}
+
+// recordDelivery appends delivery to the log of an expression that still
+// exists and reports whether it did.
+func (s *APIService) recordDelivery(expressionID models.ID, delivery *models.WebhookDelivery) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.allExpressions[expressionID]; !exists {
+		return false
+	}
+	s.webhookDeliveries[expressionID] = append(s.webhookDeliveries[expressionID], delivery)
+	return true
+}
+
+func (s *APIService) postWebhook(callbackURL string, payload []byte, attempt int) *models.WebhookDelivery {
+	delivery := &models.WebhookDelivery{
+		Attempt:   attempt,
+		URL:       callbackURL,
+		Timestamp: time.Now(),
+	}
+
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(payload))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, SignPayload(s.WebhookSecret, payload))
+	req.Header.Set("X-Calc-Delivery-Attempt", strconv.Itoa(attempt))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	defer utils.CloseResponseBody(resp.Body)
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		delivery.Success = true
+	} else {
+		delivery.Error = resp.Status
+	}
+	return delivery
+}
+
+func (s *APIService) GetWebhookDeliveries(expressionID models.ID) ([]*models.WebhookDelivery, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.allExpressions[expressionID]; !exists {
+		return nil, false
+	}
+	deliveries := append([]*models.WebhookDelivery{}, s.webhookDeliveries[expressionID]...)
+	return deliveries, true
+}
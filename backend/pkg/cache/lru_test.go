@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUEviction(t *testing.T) {
+	c := NewLRU[string, int](2, 0)
+	c.Put("a", 1)
+	c.Put("b", 2)
+	c.Get("a")
+	c.Put("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("least recently used key \"b\" was not evicted")
+	}
+	if value, ok := c.Get("a"); !ok || value != 1 {
+		t.Errorf("Get(\"a\") = %v, %v, expected 1, true", value, ok)
+	}
+	if value, ok := c.Get("c"); !ok || value != 3 {
+		t.Errorf("Get(\"c\") = %v, %v, expected 3, true", value, ok)
+	}
+
+	stats := c.Stats()
+	if stats.Size != 2 || stats.Hits != 3 || stats.Misses != 1 {
+		t.Errorf("Stats() = %+v, expected size 2, 3 hits, 1 miss", stats)
+	}
+}
+
+func TestLRUTTL(t *testing.T) {
+	now := time.Now()
+	c := NewLRU[string, int](2, time.Minute)
+	c.now = func() time.Time { return now }
+	c.Put("a", 1)
+
+	now = now.Add(30 * time.Second)
+	if _, ok := c.Get("a"); !ok {
+		t.Error("entry expired before its ttl")
+	}
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Error("entry did not expire after its ttl")
+	}
+	if stats := c.Stats(); stats.Size != 0 {
+		t.Errorf("expired entry was not removed, size = %d", stats.Size)
+	}
+}
+
+func TestLRUDisabled(t *testing.T) {
+	c := NewLRU[string, int](0, 0)
+	c.Put("a", 1)
+	if _, ok := c.Get("a"); ok {
+		t.Error("cache with zero capacity stored a value")
+	}
+}
@@ -2,7 +2,10 @@ package calc
 
 import (
 	"calc-website/pkg/utils"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"strconv"
 	"unicode"
 )
 
@@ -13,9 +16,9 @@ var (
 )
 
 type Node struct {
-	Value string
-	Right *Node
-	Left  *Node
+	Value string `json:"value"`
+	Right *Node  `json:"right,omitempty"`
+	Left  *Node  `json:"left,omitempty"`
 }
 
 var OperationPriorities = map[string]int{
@@ -208,3 +211,29 @@ func (n *Node) Infix() string {
 	}
 	return "(" + n.Left.Infix() + " " + n.Value + " " + n.Right.Infix() + ")"
 }
+
+// Hashes returns a structural hash for every subtree of n. Identical subtrees
+// get identical hashes no matter where they appear, so they can be computed once.
+func (n *Node) Hashes() map[*Node]string {
+	hashes := make(map[*Node]string)
+	n.hash(hashes)
+	return hashes
+}
+
+func (n *Node) hash(hashes map[*Node]string) string {
+	if n == nil {
+		return ""
+	}
+	var key string
+	if n.Left == nil && n.Right == nil {
+		key = "n:" + n.Value
+		if value, err := strconv.ParseFloat(n.Value, 64); err == nil {
+			key = "n:" + strconv.FormatFloat(value, 'g', -1, 64)
+		}
+	} else {
+		key = "o:" + n.Value + ":" + n.Left.hash(hashes) + ":" + n.Right.hash(hashes)
+	}
+	sum := sha256.Sum256([]byte(key))
+	hashes[n] = hex.EncodeToString(sum[:])
+	return hashes[n]
+}
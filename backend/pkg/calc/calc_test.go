@@ -106,3 +106,22 @@ func TestToTree(t *testing.T) {
 		}
 	}
 }
+
+func TestHashes(t *testing.T) {
+	tree, err := ToTree("(2+3)*(2 + 03) + 3+2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := tree.Hashes()
+
+	product := tree.Left.Left
+	if hashes[product.Left] != hashes[product.Right] {
+		t.Errorf("identical subtrees %q and %q have different hashes", product.Left.Infix(), product.Right.Infix())
+	}
+	if hashes[product.Left] == hashes[tree.Left] {
+		t.Errorf("different subtrees %q and %q have the same hash", product.Left.Infix(), tree.Left.Infix())
+	}
+	if len(hashes) != 11 {
+		t.Errorf("len(Hashes()) = %d, expected 11", len(hashes))
+	}
+}
@@ -0,0 +1,111 @@
+package calc
+
+import "strconv"
+
+// Optimize returns a rewritten copy of the tree with algebraic identities
+// (x*1, x+0, x-0, x/1, x*0, x-x) applied and chains of the commutative
+// operators + and * reassociated into balanced trees, so independent operations
+// can run in parallel. Operations on two numbers are left for the agents.
+// x*0 and x-x are not applied when x contains a division, which may fail.
+func Optimize(root Node) Node {
+	return *balance(simplify(&root))
+}
+
+func isConstant(n *Node, value float64) bool {
+	if n.Left != nil || n.Right != nil {
+		return false
+	}
+	parsed, err := strconv.ParseFloat(n.Value, 64)
+	return err == nil && parsed == value
+}
+
+func equalTrees(a, b *Node) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Value != b.Value {
+		return false
+	}
+	return equalTrees(a.Left, b.Left) && equalTrees(a.Right, b.Right)
+}
+
+// hasDivision reports whether computing n may divide by zero.
+func hasDivision(n *Node) bool {
+	if n == nil {
+		return false
+	}
+	return n.Value == "/" || hasDivision(n.Left) || hasDivision(n.Right)
+}
+
+func simplify(n *Node) *Node {
+	if n.Left == nil && n.Right == nil {
+		return &Node{Value: n.Value}
+	}
+	left, right := simplify(n.Left), simplify(n.Right)
+
+	switch n.Value {
+	case "+":
+		if isConstant(left, 0) {
+			return right
+		}
+		if isConstant(right, 0) {
+			return left
+		}
+	case "-":
+		if isConstant(right, 0) {
+			return left
+		}
+		if equalTrees(left, right) && !hasDivision(left) {
+			return &Node{Value: "0"}
+		}
+	case "*":
+		if (isConstant(left, 0) && !hasDivision(right)) || (isConstant(right, 0) && !hasDivision(left)) {
+			return &Node{Value: "0"}
+		}
+		if isConstant(left, 1) {
+			return right
+		}
+		if isConstant(right, 1) {
+			return left
+		}
+	case "/":
+		if isConstant(right, 1) {
+			return left
+		}
+	}
+	return &Node{Value: n.Value, Left: left, Right: right}
+}
+
+func balance(n *Node) *Node {
+	if n.Left == nil && n.Right == nil {
+		return n
+	}
+	if n.Value != "+" && n.Value != "*" {
+		return &Node{Value: n.Value, Left: balance(n.Left), Right: balance(n.Right)}
+	}
+
+	var operands []*Node
+	collectOperands(n, n.Value, &operands)
+	return buildBalanced(operands, n.Value)
+}
+
+func collectOperands(n *Node, operator string, operands *[]*Node) {
+	if n.Value == operator && n.Left != nil && n.Right != nil {
+		collectOperands(n.Left, operator, operands)
+		collectOperands(n.Right, operator, operands)
+		return
+	}
+	*operands = append(*operands, balance(n))
+}
+
+func buildBalanced(operands []*Node, operator string) *Node {
+	if len(operands) == 1 {
+		return operands[0]
+	}
+	middle := len(operands) / 2
+	return &Node{
+		Value: operator,
+		Left:  buildBalanced(operands[:middle], operator),
+		Right: buildBalanced(operands[middle:], operator),
+	}
+}
@@ -0,0 +1,34 @@
+package calc
+
+import "testing"
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		expression    string
+		expectedInfix string
+	}{
+		{"3*1+0", "3"},
+		{"1*(2+3)", "(2 + 3)"},
+		{"(4+5)*0+7", "7"},
+		{"(2*3)-(2*3)+8", "8"},
+		{"6-0+9/1", "(6 + 9)"},
+		{"1+2+3+4", "((1 + 2) + (3 + 4))"},
+		{"2*3*4*5+1", "(((2 * 3) * (4 * 5)) + 1)"},
+		{"8-4-2", "((8 - 4) - 2)"},
+		// subtrees with a division may fail, so they are kept
+		{"(3/(2-2))*0", "((3 / 0) * 0)"},
+		{"0*(6/3)", "(0 * (6 / 3))"},
+		{"(1/(2-2))-(1/(2-2))", "((1 / 0) - (1 / 0))"},
+	}
+
+	for _, tc := range tests {
+		tree, err := ToTree(tc.expression)
+		if err != nil {
+			t.Fatalf("ToTree(%q) returned error: %v", tc.expression, err)
+		}
+		optimized := Optimize(tree)
+		if infix := optimized.Infix(); infix != tc.expectedInfix {
+			t.Errorf("Optimize(%q).Infix() = %q, expected %q", tc.expression, infix, tc.expectedInfix)
+		}
+	}
+}
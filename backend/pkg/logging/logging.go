@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// RequestIDHeader carries the ID of an HTTP request in both directions.
+const RequestIDHeader = "X-Request-ID"
+
+// Level is the minimum level of the default logger; it may be changed at runtime.
+var Level = new(slog.LevelVar)
+
+type requestIDKey struct{}
+
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// ParseLevel accepts debug, info, warn or error in any case.
+func ParseLevel(level string) (slog.Level, error) {
+	var parsed slog.Level
+	err := parsed.UnmarshalText([]byte(strings.TrimSpace(level)))
+	return parsed, err
+}
+
+// contextHandler adds the request ID stored in the context to every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := RequestID(ctx); requestID != "" {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// NewLogger returns a JSON logger writing to w at Level.
+func NewLogger(w io.Writer) *slog.Logger {
+	return slog.New(contextHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: Level})})
+}
+
+// Setup installs a JSON logger writing to w as the default logger, which the
+// log package also writes through. An unknown level leaves Level at info and
+// is returned as an error.
+func Setup(w io.Writer, level string) error {
+	slog.SetDefault(NewLogger(w))
+	if err := SetLevel(level); err != nil {
+		Level.Set(slog.LevelInfo)
+		return err
+	}
+	return nil
+}
+
+// SetLevel changes Level; an unknown level leaves it unchanged.
+func SetLevel(level string) error {
+	parsed, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Level.Set(parsed)
+	return nil
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	for input, expected := range map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"INFO":  slog.LevelInfo,
+		" warn": slog.LevelWarn,
+		"error": slog.LevelError,
+	} {
+		if level, err := ParseLevel(input); err != nil || level != expected {
+			t.Errorf("ParseLevel(%q) = %v, %v, expected %v", input, level, err, expected)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(\"verbose\") accepted an unknown level")
+	}
+}
+
+func TestLoggerAddsRequestID(t *testing.T) {
+	defer Level.Set(slog.LevelInfo)
+	Level.Set(slog.LevelWarn)
+
+	var buf bytes.Buffer
+	logger := NewLogger(&buf)
+	ctx := WithRequestID(context.Background(), "req-1")
+	logger.InfoContext(ctx, "dropped")
+	logger.WarnContext(ctx, "kept", "task_id", "t1")
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("output is not a single JSON record: %q", buf.String())
+	}
+	if record["msg"] != "kept" || record["request_id"] != "req-1" || record["task_id"] != "t1" {
+		t.Errorf("unexpected record %v", record)
+	}
+}
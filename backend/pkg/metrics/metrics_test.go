@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Header().Get("Content-Type") != ContentType {
+		t.Errorf("Content-Type = %q, expected %q", recorder.Header().Get("Content-Type"), ContentType)
+	}
+	body, _ := io.ReadAll(recorder.Body)
+	return string(body)
+}
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounterVec("tasks_total", "Tasks by operation.", "operation")
+	gauge := r.NewGauge("busy", "Busy workers.")
+	r.NewGaugeFunc("depth", "Queue depth.", func() float64 { return 7 })
+	histogram := r.NewHistogramVec("latency_seconds", "Latency.", []float64{1, 0.5}, "route")
+
+	counter.Inc("+")
+	counter.Add(2, "*")
+	counter.Add(-5, "*")
+	counter.Inc(`a"b\c`)
+	gauge.Add(3)
+	gauge.Add(-1)
+	histogram.Observe(0.2, "/x")
+	histogram.Observe(0.7, "/x")
+	histogram.Observe(3, "/x")
+
+	expected := `# HELP tasks_total Tasks by operation.
+# TYPE tasks_total counter
+tasks_total{operation="*"} 2
+tasks_total{operation="+"} 1
+tasks_total{operation="a\"b\\c"} 1
+# HELP busy Busy workers.
+# TYPE busy gauge
+busy 2
+# HELP depth Queue depth.
+# TYPE depth gauge
+depth 7
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/x",le="0.5"} 1
+latency_seconds_bucket{route="/x",le="1"} 2
+latency_seconds_bucket{route="/x",le="+Inf"} 3
+latency_seconds_sum{route="/x"} 3.9
+latency_seconds_count{route="/x"} 3
+`
+	if got := scrape(t, r); got != expected {
+		t.Errorf("unexpected exposition:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestLabelCountMismatch(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounterVec("tasks_total", "Tasks.", "operation")
+	defer func() {
+		if recover() == nil {
+			t.Error("Inc without label values did not panic")
+		}
+	}()
+	counter.Inc()
+}
+
+func TestEmptyVecHasHeaderOnly(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("tasks_total", "Tasks.", "operation")
+	if got := scrape(t, r); strings.Count(got, "\n") != 2 {
+		t.Errorf("expected only HELP and TYPE lines, got:\n%s", got)
+	}
+}
@@ -0,0 +1,213 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header carries the W3C trace context between services.
+const Header = "traceparent"
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != "" && sc.SpanID != ""
+}
+
+// String formats sc as a version 00 traceparent header value.
+func (sc SpanContext) String() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+}
+
+// Parse reads a traceparent header value. Malformed values and the all-zero
+// IDs the specification forbids are rejected.
+func Parse(traceparent string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isHex(version) || !isHex(traceID) || len(traceID) != 32 || !isHex(spanID) || len(spanID) != 16 ||
+		!isHex(flags) || len(flags) != 2 {
+		return SpanContext{}, false
+	}
+	if traceID == strings.Repeat("0", 32) || spanID == strings.Repeat("0", 16) {
+		return SpanContext{}, false
+	}
+	flagBits, _ := hex.DecodeString(flags)
+	return SpanContext{TraceID: traceID, SpanID: spanID, Sampled: flagBits[0]&1 == 1}, true
+}
+
+func isHex(value string) bool {
+	for _, r := range value {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Span is a finished unit of work as handed to an Exporter.
+type Span struct {
+	Name       string            `json:"name"`
+	Service    string            `json:"service"`
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type Exporter interface {
+	Export(span Span)
+}
+
+// NopExporter discards spans.
+type NopExporter struct{}
+
+func (NopExporter) Export(Span) {}
+
+// MemoryExporter keeps finished spans in memory, mostly for tests.
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (e *MemoryExporter) Export(span Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func (e *MemoryExporter) Spans() []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Span{}, e.spans...)
+}
+
+// FileExporter appends spans to a file as JSON lines.
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file}, nil
+}
+
+func (e *FileExporter) Export(span Span) {
+	line, err := json.Marshal(span)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, _ = e.file.Write(append(line, '\n'))
+}
+
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
+
+// NewExporter returns a FileExporter for path, or a NopExporter when path is empty.
+func NewExporter(path string) (Exporter, error) {
+	if path == "" {
+		return NopExporter{}, nil
+	}
+	return NewFileExporter(path)
+}
+
+type Tracer struct {
+	service  string
+	exporter Exporter
+}
+
+func NewTracer(service string, exporter Exporter) *Tracer {
+	return &Tracer{service: service, exporter: exporter}
+}
+
+// ActiveSpan is a span that has started but not ended. It is not safe for
+// concurrent use.
+type ActiveSpan struct {
+	span    Span
+	sampled bool
+	tracer  *Tracer
+	ended   bool
+}
+
+// Start begins a span as a child of parent, or as the root of a new sampled
+// trace when parent is not valid.
+func (t *Tracer) Start(name string, parent SpanContext) *ActiveSpan {
+	span := &ActiveSpan{
+		span: Span{
+			Name:    name,
+			Service: t.service,
+			SpanID:  randomHex(8),
+			Start:   time.Now(),
+		},
+		sampled: true,
+		tracer:  t,
+	}
+	if parent.IsValid() {
+		span.span.TraceID = parent.TraceID
+		span.span.ParentID = parent.SpanID
+		span.sampled = parent.Sampled
+	} else {
+		span.span.TraceID = randomHex(16)
+	}
+	return span
+}
+
+func (s *ActiveSpan) Context() SpanContext {
+	return SpanContext{TraceID: s.span.TraceID, SpanID: s.span.SpanID, Sampled: s.sampled}
+}
+
+func (s *ActiveSpan) SetAttribute(key, value string) {
+	if s.span.Attributes == nil {
+		s.span.Attributes = make(map[string]string)
+	}
+	s.span.Attributes[key] = value
+}
+
+// End finishes the span and exports it if the trace is sampled. Later calls
+// have no effect.
+func (s *ActiveSpan) End() {
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.span.End = time.Now()
+	if s.sampled {
+		s.tracer.exporter.Export(s.span)
+	}
+}
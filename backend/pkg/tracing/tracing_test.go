@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	valid := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := Parse(valid)
+	if !ok || sc.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Fatalf("Parse(%q) = %+v, %v", valid, sc, ok)
+	}
+	if sc.String() != valid {
+		t.Errorf("String() = %q, expected %q", sc.String(), valid)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := Parse(invalid); ok {
+			t.Errorf("Parse(%q) accepted an invalid header", invalid)
+		}
+	}
+	if _, ok := Parse("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); !ok {
+		t.Error("Parse() rejected a future version with extra fields")
+	}
+}
+
+func TestSpanHierarchy(t *testing.T) {
+	exporter := &MemoryExporter{}
+	tracer := NewTracer("test", exporter)
+
+	root := tracer.Start("root", SpanContext{})
+	child := tracer.Start("child", root.Context())
+	child.SetAttribute("key", "value")
+	child.End()
+	child.End()
+	root.End()
+
+	unsampled := tracer.Start("unsampled", SpanContext{TraceID: root.Context().TraceID, SpanID: root.Context().SpanID})
+	unsampled.End()
+
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, expected 2", len(spans))
+	}
+	if spans[0].Name != "child" || spans[0].TraceID != spans[1].TraceID || spans[0].ParentID != spans[1].SpanID {
+		t.Errorf("child span %+v is not linked to root %+v", spans[0], spans[1])
+	}
+	if spans[0].Attributes["key"] != "value" || spans[0].Service != "test" {
+		t.Errorf("unexpected child span %+v", spans[0])
+	}
+	if spans[1].ParentID != "" || spans[1].End.Before(spans[1].Start) {
+		t.Errorf("unexpected root span %+v", spans[1])
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	exporter, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer("test", exporter)
+	tracer.Start("first", SpanContext{}).End()
+	tracer.Start("second", SpanContext{}).End()
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var span Span
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, span.Name)
+	}
+	if len(names) != 2 || names[0] != "first" || names[1] != "second" {
+		t.Errorf("file contains spans %v, expected [first second]", names)
+	}
+}
@@ -1,20 +1,29 @@
 package utils
 
 import (
+	"crypto/subtle"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"strconv"
+	"strings"
 )
 
 var ErrArrayEmpty = errors.New("array is empty")
 
 func CloseResponseBody(body io.Closer) {
 	if err := body.Close(); err != nil {
-		log.Printf("close body error: %v", err)
+		slog.Warn("close body error", "error", err)
 	}
 }
 
+// BearerTokenValid reports whether an Authorization header carries token as
+// a bearer token. An empty token never matches.
+func BearerTokenValid(authorization, token string) bool {
+	presented, found := strings.CutPrefix(authorization, "Bearer ")
+	return found && token != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
 func Pop[T any](array *[]T) (T, error) {
 	if len(*array) == 0 {
 		var zeroVar T